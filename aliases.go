@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/psanford/lambda-email/registry"
+)
+
+const defaultAliasPrefix = "/aliases"
+
+// Unknown alias policies.
+const (
+	// add the alias to the registry and process the message normally
+	aliasRegister = "register"
+	// forward the message with a warning without registering the alias
+	aliasWarn = "warn"
+	// quarantine the message; releasing it registers the alias
+	aliasQuarantine = "quarantine"
+	// bounce the message as if the mailbox did not exist
+	aliasBounce = "bounce"
+)
+
+// AliasRegistry records every alias that receives mail in the
+// message bucket, one JSON object per alias (see registry.Alias).
+// Unknown sets what happens to mail for aliases that are not in the
+// registry. Mail to disabled aliases is dropped.
+type AliasRegistry struct {
+	Enabled bool   `toml:"enabled"`
+	Unknown string `toml:"unknown"`
+}
+
+func (r *AliasRegistry) validate() error {
+	switch r.Unknown {
+	case "", aliasRegister, aliasWarn, aliasQuarantine, aliasBounce:
+	default:
+		return fmt.Errorf("aliases.unknown must be one of %s, %s, %s or %s", aliasRegister, aliasWarn, aliasQuarantine, aliasBounce)
+	}
+	return nil
+}
+
+func (r *AliasRegistry) unknown() string {
+	if r.Unknown == "" {
+		return aliasRegister
+	}
+	return r.Unknown
+}
+
+func (c *Config) AliasPrefix() string {
+	if c.Bucket.AliasPrefix == "" {
+		return defaultAliasPrefix
+	}
+	return c.Bucket.AliasPrefix
+}
+
+func aliasKey(addr string) string {
+	return path.Join(conf.AliasPrefix(), strings.ToLower(addr))
+}
+
+// unknownAliasDecision is the policy decision recorded for a message
+// quarantined because its alias is not registered.
+var unknownAliasDecision = policyDecision{
+	action: policyQuarantine,
+	verdicts: []verdict{
+		{name: "alias", status: "UNKNOWN", failed: true, action: policyQuarantine},
+	},
+}
+
+// getAlias returns the registry entry for addr, or nil if addr is not
+// registered.
+func getAlias(addr string) (*registry.Alias, error) {
+	key := aliasKey(addr)
+	obj, err := s3GetObj(&s3.GetObjectInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get alias %s err: %w", addr, err)
+	}
+	defer obj.Body.Close()
+
+	var a registry.Alias
+	if err := json.NewDecoder(obj.Body).Decode(&a); err != nil {
+		return nil, fmt.Errorf("decode alias %s err: %w", addr, err)
+	}
+	return &a, nil
+}
+
+// recordAlias registers addr, or updates its last used time if it is
+// already registered. The entry is read again rather than taken from
+// the plan so that changes made since, such as disabling the alias
+// from the outbox cli, are kept.
+func recordAlias(addr string, record events.SimpleEmailRecord) error {
+	var (
+		mail = record.SES.Mail
+		now  = time.Now()
+		a    registry.Alias
+	)
+
+	existing, err := getAlias(addr)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		a = *existing
+	} else {
+		a = registry.Alias{
+			Alias:       strings.ToLower(addr),
+			Status:      registry.StatusActive,
+			CreatedAt:   now,
+			FirstSender: strings.Trim(mail.Source, "<>"),
+		}
+		if len(mail.CommonHeaders.From) > 0 {
+			a.FirstSender = mail.CommonHeaders.From[0]
+		}
+	}
+	a.LastUsedAt = &now
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	key := aliasKey(addr)
+	_, err = s3PutObj(&s3manager.UploadInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
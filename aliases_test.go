@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/registry"
+)
+
+func TestAliasRegistry(t *testing.T) {
+	sendEmail = fakeSendEmail
+	sendBounce = fakeSendBounce
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3CopyObj = fakeCopyObj
+	defer func() {
+		sentEmails = nil
+		sentBounces = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	const alias = "test@my-ses-email-domain.example.com"
+
+	checks := []struct {
+		name       string
+		unknown    string
+		registered *registry.Alias
+		forwarded  bool
+		bounced    bool
+		warned     bool
+		register   bool
+	}{
+		{name: "register", unknown: aliasRegister, forwarded: true, register: true},
+		{name: "default", forwarded: true, register: true},
+		{name: "warn", unknown: aliasWarn, forwarded: true, warned: true},
+		{name: "quarantine", unknown: aliasQuarantine},
+		{name: "bounce", unknown: aliasBounce, bounced: true},
+		{
+			name:       "registered",
+			unknown:    aliasBounce,
+			registered: &registry.Alias{Alias: alias, Status: registry.StatusActive, Note: "signed up at example shop"},
+			forwarded:  true,
+			register:   true,
+		},
+		{
+			name:       "disabled",
+			unknown:    aliasRegister,
+			registered: &registry.Alias{Alias: alias, Status: registry.StatusDisabled},
+		},
+	}
+
+	for _, check := range checks {
+		conf = &Config{
+			Domain:                "my-ses-email-domain.example.com",
+			PrivateAccountAddress: "foo@gmail.example.com",
+			Bucket: Bucket{
+				Name:              "westerly-tapir",
+				MsgPrefix:         "/periphery-corollas",
+				ForwardMetaPrefix: "/Voldemort-wearily",
+				QuarantinePrefix:  "/quarantine-" + check.name,
+				AliasPrefix:       "/aliases-" + check.name,
+			},
+			Aliases: AliasRegistry{Enabled: true, Unknown: check.unknown},
+		}
+
+		key := bucketKey{conf.Bucket.Name, "/aliases-" + check.name + "/" + alias}
+		if check.registered != nil {
+			b, err := json.Marshal(check.registered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeS3[key] = b
+		}
+
+		sse := loadTestEvent(t)
+		id := sse.Records[0].SES.Mail.MessageID
+		putTestMessage(t, id, "test_data/msg0")
+
+		sentEmails = nil
+		sentBounces = nil
+
+		if err := Handler(sse); err != nil {
+			t.Fatalf("%s: %s", check.name, err)
+		}
+
+		if (len(sentBounces) == 1) != check.bounced {
+			t.Errorf("%s: expected bounced=%t got %d bounces", check.name, check.bounced, len(sentBounces))
+		}
+
+		var forwarded bool
+		for _, sent := range sentEmails {
+			if *sent.input.Source != alias {
+				continue
+			}
+			forwarded = true
+			env, err := enmime.ReadEnvelope(bytes.NewReader(sent.input.RawMessage.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := env.GetHeader("X-Lambdaemail-Alias") == "unknown" && env.GetHeader("Subject") == "[unknown alias] save off header"
+			if warned != check.warned {
+				t.Errorf("%s: expected warned=%t got subject %q", check.name, check.warned, env.GetHeader("Subject"))
+			}
+		}
+		if forwarded != check.forwarded {
+			t.Errorf("%s: expected forwarded=%t got %t", check.name, check.forwarded, forwarded)
+		}
+
+		stored, found := fakeS3[key]
+		if !check.register {
+			if check.registered == nil && found {
+				t.Errorf("%s: expected alias not to be registered", check.name)
+			}
+			continue
+		}
+		if !found {
+			t.Fatalf("%s: expected alias to be registered", check.name)
+		}
+		var got registry.Alias
+		if err := json.Unmarshal(stored, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.LastUsedAt == nil || time.Since(*got.LastUsedAt) > time.Minute {
+			t.Errorf("%s: expected last used time to be set got %v", check.name, got.LastUsedAt)
+		}
+		got.LastUsedAt = nil
+		expect := registry.Alias{
+			Alias:       alias,
+			Status:      registry.StatusActive,
+			CreatedAt:   got.CreatedAt,
+			FirstSender: "Peter Sanford <psanford@example.com>",
+		}
+		if check.registered != nil {
+			expect = *check.registered
+		}
+		if diff := deep.Equal(got, expect); diff != nil {
+			t.Errorf("%s: registry entry: %s", check.name, diff)
+		}
+	}
+}
+
+// TestAliasRegistryMixedRecipients checks that an unknown alias
+// bounce only bounces the unknown recipient and the message is still
+// forwarded for a registered one.
+func TestAliasRegistryMixedRecipients(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			AliasPrefix:       "/aliases-mixed",
+		},
+		Aliases: AliasRegistry{Enabled: true, Unknown: aliasBounce},
+	}
+	sendEmail = fakeSendEmail
+	sendBounce = fakeSendBounce
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	defer func() {
+		sentEmails = nil
+		sentBounces = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	const known = "known@my-ses-email-domain.example.com"
+	b, err := json.Marshal(registry.Alias{Alias: known, Status: registry.StatusActive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeS3[bucketKey{conf.Bucket.Name, "/aliases-mixed/" + known}] = b
+
+	sse := loadTestEvent(t)
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+	recipients := []string{"test@my-ses-email-domain.example.com", known}
+	sse.Records[0].SES.Mail.Destination = recipients
+	sse.Records[0].SES.Receipt.Recipients = recipients
+
+	sentEmails = nil
+	sentBounces = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentBounces) != 1 {
+		t.Fatalf("expected 1 bounce got %d", len(sentBounces))
+	}
+	bounced := sentBounces[0].BouncedRecipientInfoList
+	if len(bounced) != 1 || *bounced[0].Recipient != "test@my-ses-email-domain.example.com" {
+		t.Errorf("expected only the unknown alias to be bounced got %v", bounced)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	if got := *sentEmails[0].input.Destinations[0]; got != "foo+known@gmail.example.com" {
+		t.Errorf("forwarded to %s", got)
+	}
+}
+
+// TestRecordAliasKeepsStatus checks that recording a use of an alias
+// doesn't revert a status change made after the message was planned.
+func TestRecordAliasKeepsStatus(t *testing.T) {
+	conf = &Config{
+		Domain: "my-ses-email-domain.example.com",
+		Bucket: Bucket{
+			Name:        "westerly-tapir",
+			AliasPrefix: "/aliases-status",
+		},
+	}
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+
+	const alias = "test@my-ses-email-domain.example.com"
+	stored := registry.Alias{Alias: alias, Status: registry.StatusDisabled, Note: "disabled from the cli"}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bucketKey{conf.Bucket.Name, "/aliases-status/" + alias}
+	fakeS3[key] = b
+
+	if err := recordAlias(alias, loadTestEvent(t).Records[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var got registry.Alias
+	if err := json.Unmarshal(fakeS3[key], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.LastUsedAt == nil {
+		t.Errorf("expected last used time to be set")
+	}
+	got.LastUsedAt = nil
+	if diff := deep.Equal(got, stored); diff != nil {
+		t.Errorf("registry entry: %s", diff)
+	}
+}
+
+// TestAliasRegistryRelease checks that releasing a message
+// quarantined for an unknown alias registers the alias.
+func TestAliasRegistryRelease(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			QuarantinePrefix:  "/quarantine-release",
+			AliasPrefix:       "/aliases-release",
+		},
+		Aliases: AliasRegistry{Enabled: true, Unknown: aliasQuarantine},
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3CopyObj = fakeCopyObj
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessage(t, id, "test_data/msg0")
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	info, err := releaseQuarantine(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(info.Reasons, []string{"alias=UNKNOWN"}); diff != nil {
+		t.Errorf("quarantine reasons: %s", diff)
+	}
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected released message to be forwarded got %d emails", len(sentEmails))
+	}
+	if _, found := fakeS3[bucketKey{conf.Bucket.Name, "/aliases-release/test@my-ses-email-domain.example.com"}]; !found {
+		t.Errorf("expected released alias to be registered")
+	}
+}
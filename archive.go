@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3TagValueRe matches the characters S3 allows in tag values.
+var s3TagValueRe = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// Archive copies the raw message to a key under Prefix. Prefix is a
+// text/template executed with keyData; the message id is appended
+// to it.
+type Archive struct {
+	Prefix string `toml:"prefix"`
+
+	// prefix is the parsed Prefix template, set by compile
+	prefix *template.Template
+}
+
+// keyData is available to templated bucket keys.
+type keyData struct {
+	MessageID    string
+	Alias        string
+	SenderDomain string
+	Date         string
+	Year         string
+	Month        string
+	Day          string
+}
+
+// newKeyData returns the key template data for a message. Dates are
+// the time SES received the message, in UTC. Fields taken from the
+// message's addresses are made safe to use as a single key path
+// element.
+func newKeyData(record events.SimpleEmailRecord) keyData {
+	mail := record.SES.Mail
+
+	ts := mail.Timestamp.UTC()
+	data := keyData{
+		MessageID: mail.MessageID,
+		Alias:     keyElement(strings.SplitN(proxyRecipient(record), "@", 2)[0]),
+		Date:      ts.Format("2006-01-02"),
+		Year:      ts.Format("2006"),
+		Month:     ts.Format("01"),
+		Day:       ts.Format("02"),
+	}
+	if parts := strings.SplitN(strings.Trim(mail.Source, "<>"), "@", 2); len(parts) == 2 {
+		data.SenderDomain = keyElement(strings.ToLower(parts[1]))
+	}
+	return data
+}
+
+// keyElement returns s with anything other than letters, numbers,
+// '.', '_' and '-' replaced by '_', so that it can't add path
+// elements to a bucket key or climb out of its prefix.
+func keyElement(s string) string {
+	s = unsafeFileNameRe.ReplaceAllString(s, "_")
+	if s == "." || s == ".." {
+		return strings.Repeat("_", len(s))
+	}
+	return s
+}
+
+// underKeyPrefix reports whether key starts with the literal prefix
+// of the key template tmpl.
+func underKeyPrefix(key, tmpl string) bool {
+	return strings.HasPrefix(key+"/", keyPrefix(tmpl))
+}
+
+func (a *Archive) validate(name string) error {
+	if a.Prefix == "" {
+		return fmt.Errorf("%s.prefix must be set", name)
+	}
+	return nil
+}
+
+// compile parses the prefix template.
+func (a *Archive) compile() error {
+	t, err := template.New("prefix").Parse(a.Prefix)
+	if err != nil {
+		return err
+	}
+	a.prefix = t
+	return nil
+}
+
+// key returns the archive key for the message.
+func (a *Archive) key(record events.SimpleEmailRecord) (string, error) {
+	var buf bytes.Buffer
+	if err := a.prefix.Execute(&buf, newKeyData(record)); err != nil {
+		return "", fmt.Errorf("archive prefix template err: %w", err)
+	}
+
+	key := path.Join("/", buf.String(), record.SES.Mail.MessageID)
+	if !underKeyPrefix(key, a.Prefix) {
+		return "", fmt.Errorf("archive key %s is outside of prefix %s", key, a.Prefix)
+	}
+	return key, nil
+}
+
+// archiveTags returns the S3 tags for an archived message: the
+// matched route name and each verdict.
+func archiveTags(route string, d policyDecision) string {
+	tags := url.Values{}
+	if route != "" {
+		tags.Set("route", route)
+	}
+	for _, v := range d.verdicts {
+		tags.Set(v.name, v.status)
+	}
+	return tags.Encode()
+}
+
+// archiveMessage copies the message to key, replacing its tags.
+func archiveMessage(key, route string, d policyDecision, record events.SimpleEmailRecord) error {
+	id := record.SES.Mail.MessageID
+	src := path.Join(conf.Bucket.Name, conf.Bucket.MsgPrefix, id)
+
+	_, err := s3CopyObj(&s3.CopyObjectInput{
+		Bucket:           &conf.Bucket.Name,
+		CopySource:       &src,
+		Key:              &key,
+		Tagging:          aws.String(archiveTags(route, d)),
+		TaggingDirective: aws.String(s3.TaggingDirectiveReplace),
+	})
+	if err != nil {
+		return fmt.Errorf("archive %s to %s err: %w", id, key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestArchive(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Name:      "receipts",
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				Archive: &Archive{
+					Prefix: "/archive/{{.Alias}}/{{.SenderDomain}}/{{.Year}}/{{.Month}}",
+				},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var copies []*s3.CopyObjectInput
+	s3CopyObj = func(i *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+		copies = append(copies, i)
+		return fakeCopyObj(i)
+	}
+	defer func() {
+		s3CopyObj = fakeCopyObj
+	}()
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessage(t, id, "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 0 {
+		t.Errorf("expected archived message not to be forwarded")
+	}
+	if len(copies) != 1 {
+		t.Fatalf("expected 1 copy got %d", len(copies))
+	}
+
+	expectKey := "/archive/test/example.com/2019/06/" + id
+	if got := *copies[0].Key; got != expectKey {
+		t.Errorf("archive key got %s expected %s", got, expectKey)
+	}
+	if _, ok := fakeS3[bucketKey{conf.Bucket.Name, expectKey}]; !ok {
+		t.Errorf("archived message not found at %s", expectKey)
+	}
+
+	tags, err := url.ParseQuery(*copies[0].Tagging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"route": "receipts", "spam": "PASS", "virus": "PASS", "spf": "PASS", "dkim": "PASS"} {
+		if got := tags.Get(k); got != v {
+			t.Errorf("tag %s got %q expected %q", k, got, v)
+		}
+	}
+	if got := *copies[0].TaggingDirective; got != s3.TaggingDirectiveReplace {
+		t.Errorf("tagging directive got %s", got)
+	}
+}
+
+func TestArchiveKeyEscape(t *testing.T) {
+	conf = &Config{Domain: "my-ses-email-domain.example.com"}
+
+	sse := loadTestEvent(t)
+	record := sse.Records[0]
+	record.SES.Receipt.Recipients = []string{"../../tenants/evil@my-ses-email-domain.example.com"}
+	record.SES.Mail.Source = "x@../../tenants"
+
+	checks := []struct {
+		prefix string
+		expect string
+	}{
+		{"/archive/{{.Alias}}", "/archive/.._.._tenants_evil/"},
+		{"/archive/{{.SenderDomain}}", "/archive/.._.._tenants/"},
+		{"/archive-{{.Alias}}", "/archive-.._.._tenants_evil/"},
+	}
+	for _, check := range checks {
+		a := Archive{Prefix: check.prefix}
+		if err := a.compile(); err != nil {
+			t.Fatal(err)
+		}
+		key, err := a.key(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := check.expect + record.SES.Mail.MessageID; key != expect {
+			t.Errorf("%s: key got %s expected %s", check.prefix, key, expect)
+		}
+	}
+
+	if got := keyElement(".."); got != "__" {
+		t.Errorf("keyElement(..) got %s", got)
+	}
+	if underKeyPrefix("/tenants/evil.toml", "/archive/{{.Alias}}") {
+		t.Errorf("expected key outside of the prefix to be rejected")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/snsmsg"
+)
+
+const (
+	defaultAttachmentPrefix = "/attachments"
+	// defaultAttachmentKey is relative to the config's attachment
+	// prefix
+	defaultAttachmentKey = "{{.MessageID}}/{{.Index}}-{{.FileName}}"
+)
+
+var unsafeFileNameRe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// Attachments saves the message's attachments to the message bucket.
+// Key is a text/template executed with attachmentData. Attachments
+// can be filtered by content type and file name globs; when both
+// are set an attachment must match both.
+type Attachments struct {
+	Key          string   `toml:"key"`
+	ContentTypes []string `toml:"content_types"`
+	FileNames    []string `toml:"filenames"`
+
+	// key is the parsed Key template, set by compile
+	key *template.Template
+}
+
+// attachmentData is available to the attachment key template.
+type attachmentData struct {
+	keyData
+	// FileName is the attachment's file name with anything other
+	// than letters, numbers, '.', '_' and '-' replaced by '_'
+	FileName string
+	// Index is the attachment's position in the message
+	Index int
+}
+
+func (a *Attachments) validate(name string) error {
+	for _, glob := range append(append([]string{}, a.ContentTypes...), a.FileNames...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("%s: invalid glob %q", name, glob)
+		}
+	}
+	return nil
+}
+
+// compile parses the key template.
+func (a *Attachments) compile() error {
+	key := a.Key
+	if key == "" {
+		key = defaultAttachmentKey
+	}
+	t, err := template.New("key").Parse(key)
+	if err != nil {
+		return err
+	}
+	a.key = t
+	return nil
+}
+
+func (a *Attachments) match(p *enmime.Part) bool {
+	return matchGlobs(a.ContentTypes, p.ContentType) && matchGlobs(a.FileNames, p.FileName)
+}
+
+// matchGlobs reports whether s case insensitively matches any of
+// globs. An empty list matches everything.
+func matchGlobs(globs []string, s string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	s = strings.ToLower(s)
+	for _, glob := range globs {
+		if ok, _ := path.Match(strings.ToLower(glob), s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// safeFileName returns the base of name with anything other than
+// letters, numbers, '.', '_' and '-' replaced by '_', for use in a
+// bucket key.
+func safeFileName(name string) string {
+	name = unsafeFileNameRe.ReplaceAllString(path.Base(name), "_")
+	if name == "" || name == "." || name == ".." || name == "_" {
+		return "attachment"
+	}
+	return name
+}
+
+func (c *Config) AttachmentPrefix() string {
+	if c.Bucket.AttachmentPrefix == "" {
+		return defaultAttachmentPrefix
+	}
+	return c.Bucket.AttachmentPrefix
+}
+
+// plannedAttachment is an attachment to save and the key to save it
+// under.
+type plannedAttachment struct {
+	key  string
+	part *enmime.Part
+}
+
+// plan returns the matching attachments of body and their keys.
+func (a *Attachments) plan(data keyData, body *enmime.Envelope) ([]plannedAttachment, error) {
+	var planned []plannedAttachment
+	for i, part := range body.Attachments {
+		if !a.match(part) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := a.key.Execute(&buf, attachmentData{
+			keyData:  data,
+			FileName: safeFileName(part.FileName),
+			Index:    i,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("attachment key template err: %w", err)
+		}
+
+		key := path.Join("/", buf.String())
+		tmpl := a.Key
+		if tmpl == "" {
+			key = path.Join(conf.AttachmentPrefix(), key)
+			tmpl = conf.AttachmentPrefix()
+		}
+		if !underKeyPrefix(key, tmpl) {
+			return nil, fmt.Errorf("attachment key %s is outside of %s", key, tmpl)
+		}
+		planned = append(planned, plannedAttachment{
+			key:  key,
+			part: part,
+		})
+	}
+
+	return planned, nil
+}
+
+// saveAttachment writes the attachment to the bucket and returns its
+// description for route payloads.
+func saveAttachment(a plannedAttachment) (snsmsg.Attachment, error) {
+	contentType := a.part.ContentType
+	_, err := s3PutObj(&s3manager.UploadInput{
+		Bucket:      &conf.Bucket.Name,
+		Key:         &a.key,
+		Body:        bytes.NewReader(a.part.Content),
+		ContentType: &contentType,
+	})
+	if err != nil {
+		return snsmsg.Attachment{}, fmt.Errorf("save attachment %s err: %w", a.key, err)
+	}
+
+	url, err := presignKey(a.key)
+	if err != nil {
+		return snsmsg.Attachment{}, fmt.Errorf("presign url for %s err: %w", a.key, err)
+	}
+
+	return snsmsg.Attachment{
+		FileName:     a.part.FileName,
+		ContentType:  a.part.ContentType,
+		Size:         len(a.part.Content),
+		Key:          a.key,
+		PresignedURL: url,
+	}, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestAttachments(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Name:      "receipts",
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:receipts",
+				Attachments: &Attachments{
+					Key:          "/receipts/{{.Alias}}/{{.MessageID}}/{{.FileName}}",
+					ContentTypes: []string{"application/pdf"},
+				},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var puts []*s3manager.UploadInput
+	s3PutObj = func(i *s3manager.UploadInput, o ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+		puts = append(puts, i)
+		return fakePutObj(i, o...)
+	}
+	defer func() {
+		s3PutObj = fakePutObj
+		snsMessages = nil
+	}()
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3GetObjReq = fakeGetObjReq
+	snsPublish = fakeSNSPublish
+
+	log.SetOutput(ioutil.Discard)
+
+	pdf := []byte("%PDF-1.4 not really a pdf")
+	root, err := enmime.Builder().
+		From("Receipts", "receipts@example.com").
+		To("", "test@my-ses-email-domain.example.com").
+		Subject("Your receipt").
+		Text([]byte("receipt attached")).
+		AddAttachment(pdf, "application/pdf", "receipt #42.pdf").
+		AddAttachment([]byte("not a png"), "image/png", "logo.png").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := root.Encode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessageBytes(t, id, raw.Bytes())
+
+	sentEmails = nil
+	snsMessages = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	expectKey := "/receipts/test/" + id + "/receipt_42.pdf"
+	if len(puts) != 1 {
+		t.Fatalf("expected 1 attachment saved got %d", len(puts))
+	}
+	if got := *puts[0].Key; got != expectKey {
+		t.Errorf("attachment key got %s expected %s", got, expectKey)
+	}
+	if got := *puts[0].ContentType; got != "application/pdf" {
+		t.Errorf("attachment content type got %s", got)
+	}
+	if got := fakeS3[bucketKey{conf.Bucket.Name, expectKey}]; !bytes.Equal(got, pdf) {
+		t.Errorf("attachment content got %q expected %q", got, pdf)
+	}
+
+	if len(snsMessages) != 1 {
+		t.Fatalf("expected 1 sns publish got %d", len(snsMessages))
+	}
+	attachments := snsMessages[0].Attachments
+	if len(attachments) != 1 {
+		t.Fatalf("expected 1 attachment in sns payload got %d", len(attachments))
+	}
+	a := attachments[0]
+	if a.Key != expectKey || a.FileName != "receipt #42.pdf" || a.ContentType != "application/pdf" || a.Size != len(pdf) {
+		t.Errorf("unexpected sns attachment %+v", a)
+	}
+	if a.PresignedURL == "" {
+		t.Errorf("expected presigned url for attachment")
+	}
+}
+
+func TestAttachmentKeyEscape(t *testing.T) {
+	conf = &Config{Domain: "my-ses-email-domain.example.com"}
+
+	root, err := enmime.Builder().
+		From("Receipts", "receipts@example.com").
+		To("", "test@my-ses-email-domain.example.com").
+		Subject("Your receipt").
+		Text([]byte("receipt attached")).
+		AddAttachment([]byte("%PDF-1.4"), "application/pdf", "..").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := root.Encode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	body, err := enmime.ReadEnvelope(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := Attachments{Key: "/receipts/{{.Alias}}/{{.FileName}}"}
+	if err := a.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	record := loadTestEvent(t).Records[0]
+	record.SES.Receipt.Recipients = []string{"../..@my-ses-email-domain.example.com"}
+	planned, err := a.plan(newKeyData(record), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned) != 1 || planned[0].key != "/receipts/.._../attachment" {
+		t.Errorf("expected key under /receipts got %+v", planned)
+	}
+
+	if _, err := a.plan(keyData{Alias: "../../tenants"}, body); err == nil {
+		t.Errorf("expected key outside of the prefix to be rejected")
+	}
+}
+
+func TestAttachmentsValidate(t *testing.T) {
+	checks := []struct {
+		a     Attachments
+		valid bool
+	}{
+		{Attachments{}, true},
+		{Attachments{Key: "/x/{{.MessageID}}/{{.Index}}-{{.FileName}}", FileNames: []string{"*.pdf"}}, true},
+		{Attachments{Key: "/x/{{.MessageID"}, false},
+		{Attachments{ContentTypes: []string{"application/["}}, false},
+	}
+
+	for i, check := range checks {
+		err := check.a.validate("attachments")
+		if err == nil {
+			err = check.a.compile()
+		}
+		if (err == nil) != check.valid {
+			t.Errorf("check %d: %+v valid=%t got err=%v", i, check.a, check.valid, err)
+		}
+	}
+}
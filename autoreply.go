@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	gomail "net/mail"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	defaultAutoreplyPrefix  = "/autoreply"
+	defaultAutoreplySubject = "Re: {{.Subject}}"
+	defaultAutoreplyDays    = 7
+)
+
+// Autoreply sends a templated reply from the proxy address back to
+// the sender, at most once every Days days per sender.
+type Autoreply struct {
+	Subject string `toml:"subject"`
+	Body    string `toml:"body"`
+	Days    int    `toml:"days"`
+
+	// tmpl holds the subject and body templates, set by compile
+	tmpl *template.Template
+}
+
+// autoreplyData is available to the subject and body templates.
+type autoreplyData struct {
+	From     string
+	FromName string
+	To       string
+	Subject  string
+	Date     string
+}
+
+func (a *Autoreply) validate(name string) error {
+	if a.Body == "" {
+		return fmt.Errorf("%s.body must be set", name)
+	}
+	if a.Days < 0 {
+		return fmt.Errorf("%s.days must not be negative", name)
+	}
+	return nil
+}
+
+// compile parses the subject and body templates.
+func (a *Autoreply) compile() error {
+	subject := a.Subject
+	if subject == "" {
+		subject = defaultAutoreplySubject
+	}
+
+	t, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return err
+	}
+	if _, err := t.New("body").Parse(a.Body); err != nil {
+		return err
+	}
+	a.tmpl = t
+	return nil
+}
+
+func (a *Autoreply) interval() time.Duration {
+	days := a.Days
+	if days == 0 {
+		days = defaultAutoreplyDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (c *Config) AutoreplyPrefix() string {
+	if c.Bucket.AutoreplyPrefix == "" {
+		return defaultAutoreplyPrefix
+	}
+	return c.Bucket.AutoreplyPrefix
+}
+
+func autoreplyStateKey(alias, sender string) string {
+	return path.Join(conf.AutoreplyPrefix(), strings.ToLower(alias), strings.ToLower(sender))
+}
+
+// autoreplySuppressed returns the reason an automatic reply must
+// not be sent to a message, or "" if it may be. Following RFC 3834
+// we never answer automated mail, mailing lists, bounces or
+// suspect messages.
+func autoreplySuppressed(record events.SimpleEmailRecord, body *enmime.Envelope, policy policyDecision) string {
+	if failed := policy.failed(); len(failed) > 0 {
+		return "suspect message"
+	}
+
+	source := strings.ToLower(strings.Trim(record.SES.Mail.Source, "<>"))
+	if source == "" {
+		return "empty return path"
+	}
+	localPart := strings.SplitN(source, "@", 2)[0]
+	if localPart == "mailer-daemon" || localPart == "postmaster" {
+		return "sender is " + localPart
+	}
+	if conf.ownsAddress(source) || conf.isDestination(source) {
+		return "sender is local"
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(body.GetHeader("Auto-Submitted"))); v != "" && v != "no" {
+		return "auto-submitted message"
+	}
+
+	switch strings.ToLower(strings.TrimSpace(body.GetHeader("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "bulk message"
+	}
+
+	for _, h := range []string{"List-Id", "List-Unsubscribe", "List-Post", "List-Help", "List-Owner"} {
+		if body.GetHeader(h) != "" {
+			return "mailing list message"
+		}
+	}
+
+	return ""
+}
+
+// sendAutoreply answers the message unless the sender was already
+// answered within the autoreply interval.
+func sendAutoreply(lgr log15.Logger, a *Autoreply, record events.SimpleEmailRecord, body *enmime.Envelope) error {
+	var (
+		mail      = record.SES.Mail
+		proxyAddr = proxyRecipient(record)
+		sender    = strings.Trim(mail.Source, "<>")
+	)
+
+	if proxyAddr == "" {
+		return fmt.Errorf("Failed to find %s address for email %s", conf.Domain, mail.MessageID)
+	}
+
+	stateKey := autoreplyStateKey(proxyAddr, sender)
+	last, err := lastAutoreply(stateKey)
+	if err != nil {
+		return err
+	}
+	if time.Since(last) < a.interval() {
+		lgr.Info("autoreply_recently_sent", "to", sender, "last", last)
+		return nil
+	}
+
+	data := autoreplyData{
+		From:    sender,
+		To:      proxyAddr,
+		Subject: mail.CommonHeaders.Subject,
+		Date:    mail.CommonHeaders.Date,
+	}
+	if len(mail.CommonHeaders.From) > 0 {
+		if addr, err := gomail.ParseAddress(mail.CommonHeaders.From[0]); err == nil {
+			data.FromName = addr.Name
+		}
+	}
+
+	var subject, text bytes.Buffer
+	if err := a.tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return fmt.Errorf("autoreply subject template err: %w", err)
+	}
+	if err := a.tmpl.ExecuteTemplate(&text, "body", data); err != nil {
+		return fmt.Errorf("autoreply body template err: %w", err)
+	}
+
+	b := enmime.Builder()
+	b = b.From("", proxyAddr)
+	b = b.To("", sender)
+	b = b.Subject(subject.String())
+	b = b.Header("Auto-Submitted", "auto-replied")
+	if msgID := mail.CommonHeaders.MessageID; msgID != "" {
+		b = b.Header("In-Reply-To", msgID)
+		b = b.Header("References", msgID)
+	}
+	b = b.Text(text.Bytes())
+
+	root, err := b.Build()
+	if err != nil {
+		return fmt.Errorf("Build autoreply email err=%q", err)
+	}
+
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		return fmt.Errorf("Encode autoreply email err=%q", err)
+	}
+
+	_, err = sendEmail(&ses.SendRawEmailInput{
+		Destinations: strList([]string{sender}),
+		RawMessage: &ses.RawMessage{
+			Data: buf.Bytes(),
+		},
+		Source: &proxyAddr,
+	})
+	if err != nil {
+		return fmt.Errorf("send autoreply error: %s", err)
+	}
+
+	lgr.Info("autoreply_sent", "to", sender, "from", proxyAddr)
+
+	now := []byte(time.Now().UTC().Format(time.RFC3339))
+	_, err = s3PutObj(&s3manager.UploadInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &stateKey,
+		Body:   bytes.NewReader(now),
+	})
+	if err != nil {
+		return fmt.Errorf("save autoreply state %s err: %w", stateKey, err)
+	}
+
+	return nil
+}
+
+// lastAutoreply returns when an autoreply was last sent for the
+// state key, or the zero time if one never was.
+func lastAutoreply(key string) (time.Time, error) {
+	obj, err := s3GetObj(&s3.GetObjectInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("get autoreply state %s err: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	b, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("read autoreply state %s err: %w", key, err)
+	}
+
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse autoreply state %s err: %w", key, err)
+	}
+	return t, nil
+}
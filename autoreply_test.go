@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+func TestAutoreply(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				Autoreply: &Autoreply{
+					Body: "Hi {{.FromName}}, we got your message about {{.Subject}}.",
+					Days: 3,
+				},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+	delete(fakeS3, bucketKey{conf.Bucket.Name, autoreplyStateKey("test@my-ses-email-domain.example.com", "psanford@example.com")})
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 email got %d", len(sentEmails))
+	}
+
+	sent := sentEmails[0]
+	if got := *sent.input.Source; got != "test@my-ses-email-domain.example.com" {
+		t.Errorf("autoreply source got %s", got)
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(sent.input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		header string
+		expect string
+	}{
+		{"To", "psanford@example.com"},
+		{"Subject", "Re: save off header"},
+		{"Auto-Submitted", "auto-replied"},
+		{"In-Reply-To", "<5B762F46B550CE2BAB51989E4F9F1280@mail.gmail.com>"},
+	}
+	for _, c := range checks {
+		if got := env.GetHeader(c.header); !strings.Contains(got, c.expect) {
+			t.Errorf("%s: got %q expected %q", c.header, got, c.expect)
+		}
+	}
+	if expect := "Hi Peter Sanford, we got your message about save off header."; env.Text != expect {
+		t.Errorf("body got %q expected %q", env.Text, expect)
+	}
+
+	// the sender was answered recently
+	sentEmails = nil
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 0 {
+		t.Errorf("expected no second autoreply, got %d emails", len(sentEmails))
+	}
+}
+
+func TestAutoreplySuppressed(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+	}
+
+	record := loadTestEvent(t).Records[0]
+	pass := decidePolicy(record.SES.Receipt, globalPolicyAction)
+
+	checks := []struct {
+		name    string
+		source  string
+		headers string
+		suspect bool
+		expect  bool
+	}{
+		{"human", "psanford@example.com", "", false, false},
+		{"auto_submitted_no", "psanford@example.com", "Auto-Submitted: no\r\n", false, false},
+		{"auto_submitted", "psanford@example.com", "Auto-Submitted: auto-generated\r\n", false, true},
+		{"bulk", "psanford@example.com", "Precedence: bulk\r\n", false, true},
+		{"list", "psanford@example.com", "List-Id: <announce.example.com>\r\n", false, true},
+		{"empty_return_path", "<>", "", false, true},
+		{"mailer_daemon", "MAILER-DAEMON@example.com", "", false, true},
+		{"local", "other@my-ses-email-domain.example.com", "", false, true},
+		{"suspect", "psanford@example.com", "", true, true},
+	}
+
+	for _, c := range checks {
+		raw := "From: a@example.com\r\nSubject: hi\r\n" + c.headers + "\r\nhello\r\n"
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := record
+		r.SES.Mail.Source = c.source
+		policy := pass
+		if c.suspect {
+			r.SES.Receipt.SpamVerdict.Status = "FAIL"
+			policy = decidePolicy(r.SES.Receipt, globalPolicyAction)
+		}
+
+		reason := autoreplySuppressed(r, env, policy)
+		if got := reason != ""; got != c.expect {
+			t.Errorf("%s: got suppressed=%t (%s) expected %t", c.name, got, reason, c.expect)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+const (
+	defaultBounceSMTPReplyCode = "550"
+	defaultBounceStatusCode    = "5.1.1"
+	defaultBounceMessage       = "Mailbox does not exist"
+)
+
+var (
+	smtpReplyCodeRe = regexp.MustCompile(`^5[0-9][0-9]$`)
+	dsnStatusCodeRe = regexp.MustCompile(`^5\.[0-9]{1,3}\.[0-9]{1,3}$`)
+)
+
+// Bounce rejects a message back to its sender with SES SendBounce.
+// Unset fields default to a 550 5.1.1 "Mailbox does not exist"
+// bounce sent from mailer-daemon@<domain>.
+type Bounce struct {
+	SMTPReplyCode string `toml:"smtp_reply_code"`
+	StatusCode    string `toml:"status_code"`
+	Message       string `toml:"message"`
+	Sender        string `toml:"sender"`
+}
+
+func (b *Bounce) validate(name string) error {
+	if b.SMTPReplyCode != "" && !smtpReplyCodeRe.MatchString(b.SMTPReplyCode) {
+		return fmt.Errorf("%s.smtp_reply_code: must be a 5xx code", name)
+	}
+	if b.StatusCode != "" && !dsnStatusCodeRe.MatchString(b.StatusCode) {
+		return fmt.Errorf("%s.status_code: must be a permanent failure status like 5.1.1", name)
+	}
+	return nil
+}
+
+func (b *Bounce) smtpReplyCode() string {
+	if b.SMTPReplyCode == "" {
+		return defaultBounceSMTPReplyCode
+	}
+	return b.SMTPReplyCode
+}
+
+func (b *Bounce) statusCode() string {
+	if b.StatusCode == "" {
+		return defaultBounceStatusCode
+	}
+	return b.StatusCode
+}
+
+func (b *Bounce) message() string {
+	if b.Message == "" {
+		return defaultBounceMessage
+	}
+	return b.Message
+}
+
+func (b *Bounce) sender() string {
+	if b.Sender == "" {
+		return "mailer-daemon@" + conf.Domain
+	}
+	return b.Sender
+}
+
+func (b *Bounce) String() string {
+	return fmt.Sprintf("%s %s %s", b.smtpReplyCode(), b.statusCode(), b.message())
+}
+
+// bounceMessage sends a bounce for each of recipients back to the
+// sender of the message.
+func bounceMessage(b *Bounce, record events.SimpleEmailRecord, bounced []string) error {
+	id := record.SES.Mail.MessageID
+
+	var recipients []*ses.BouncedRecipientInfo
+	for _, recipient := range bounced {
+		recipients = append(recipients, &ses.BouncedRecipientInfo{
+			Recipient: aws.String(recipient),
+			RecipientDsnFields: &ses.RecipientDsnFields{
+				Action:         aws.String(ses.DsnActionFailed),
+				Status:         aws.String(b.statusCode()),
+				DiagnosticCode: aws.String(fmt.Sprintf("smtp; %s %s %s", b.smtpReplyCode(), b.statusCode(), b.message())),
+			},
+		})
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipients to bounce for %s", id)
+	}
+
+	_, err := sendBounce(&ses.SendBounceInput{
+		OriginalMessageId:        aws.String(id),
+		BounceSender:             aws.String(b.sender()),
+		Explanation:              aws.String(b.message()),
+		BouncedRecipientInfoList: recipients,
+		MessageDsn: &ses.MessageDsn{
+			ReportingMta: aws.String("dns; " + conf.Domain),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("send bounce for %s err: %w", id, err)
+	}
+
+	return nil
+}
+
+// bounceRecipients returns the recipients the bounce route rule
+// matched. A route that matches the message without matching any
+// single recipient bounces none of them.
+func bounceRecipients(rule Route, msg routeMsg, recipients []string) ([]string, error) {
+	var bounced []string
+	for _, recipient := range recipients {
+		match, err := rule.Match(msg.only(recipient))
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			bounced = append(bounced, recipient)
+		}
+	}
+	return bounced, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestBounce(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				Bounce: &Bounce{
+					Message: "This address has been retired",
+				},
+				AllowSuspectMessages: true,
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	sendBounce = fakeSendBounce
+	s3GetObj = fakeGetObj
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+
+	sentEmails = nil
+	sentBounces = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 0 {
+		t.Errorf("expected bounced message not to be forwarded")
+	}
+	if len(sentBounces) != 1 {
+		t.Fatalf("expected 1 bounce got %d", len(sentBounces))
+	}
+
+	b := sentBounces[0]
+	if got := *b.OriginalMessageId; got != sse.Records[0].SES.Mail.MessageID {
+		t.Errorf("bounce original message id got %s", got)
+	}
+	if got := *b.BounceSender; got != "mailer-daemon@my-ses-email-domain.example.com" {
+		t.Errorf("bounce sender got %s", got)
+	}
+	if len(b.BouncedRecipientInfoList) != 1 {
+		t.Fatalf("expected 1 bounced recipient got %d", len(b.BouncedRecipientInfoList))
+	}
+	info := b.BouncedRecipientInfoList[0]
+	if got := *info.Recipient; got != "test@my-ses-email-domain.example.com" {
+		t.Errorf("bounced recipient got %s", got)
+	}
+	if got, expect := *info.RecipientDsnFields.DiagnosticCode, "smtp; 550 5.1.1 This address has been retired"; got != expect {
+		t.Errorf("diagnostic code got %q expected %q", got, expect)
+	}
+
+	// suspect messages are dropped rather than bounced
+	sentBounces = nil
+	sse.Records[0].SES.Receipt.SPFVerdict.Status = "FAIL"
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentBounces) != 0 || len(sentEmails) != 0 {
+		t.Errorf("expected suspect message to be dropped, got %d bounces and %d emails", len(sentBounces), len(sentEmails))
+	}
+
+	for _, b := range []Bounce{{SMTPReplyCode: "250"}, {StatusCode: "4.2.2"}} {
+		if err := b.validate("bounce"); err == nil {
+			t.Errorf("expected %+v to fail validation", b)
+		}
+	}
+}
+
+// TestBounceMixedRecipients checks that only the recipients matching
+// a bounce route are bounced and the message is still forwarded for
+// the others.
+func TestBounceMixedRecipients(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Src: "/.*/", Dst: "test@my-ses-email-domain.example.com"},
+				Bounce:    &Bounce{},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	sendBounce = fakeSendBounce
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	defer func() {
+		sentEmails = nil
+		sentBounces = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+
+	recipients := []string{"test@my-ses-email-domain.example.com", "live@my-ses-email-domain.example.com"}
+	sse.Records[0].SES.Mail.CommonHeaders.To = recipients
+	sse.Records[0].SES.Mail.Destination = recipients
+	sse.Records[0].SES.Receipt.Recipients = recipients
+
+	sentEmails = nil
+	sentBounces = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentBounces) != 1 {
+		t.Fatalf("expected 1 bounce got %d", len(sentBounces))
+	}
+	bounced := sentBounces[0].BouncedRecipientInfoList
+	if len(bounced) != 1 || *bounced[0].Recipient != "test@my-ses-email-domain.example.com" {
+		t.Errorf("expected only test@ to be bounced got %v", bounced)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	if got := *sentEmails[0].input.Destinations[0]; got != "foo+live@gmail.example.com" {
+		t.Errorf("forwarded to %s", got)
+	}
+}
+
+// TestBounceNoRecipients checks that a bounce route that matches the
+// message but none of its recipients doesn't bounce anyone.
+func TestBounceNoRecipients(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				Bounce:    &Bounce{},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	sendBounce = fakeSendBounce
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	defer func() {
+		sentEmails = nil
+		sentBounces = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	// the message is addressed to test@ but only delivered to live@
+	sse := loadTestEvent(t)
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+	sse.Records[0].SES.Mail.CommonHeaders.To = []string{"test@my-ses-email-domain.example.com"}
+	sse.Records[0].SES.Mail.Destination = []string{"live@my-ses-email-domain.example.com"}
+	sse.Records[0].SES.Receipt.Recipients = []string{"live@my-ses-email-domain.example.com"}
+
+	sentEmails = nil
+	sentBounces = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentBounces) != 0 {
+		t.Errorf("expected no bounce got %d", len(sentBounces))
+	}
+	if len(sentEmails) != 1 || *sentEmails[0].input.Destinations[0] != "foo+live@gmail.example.com" {
+		t.Errorf("expected message to be forwarded for live@ got %d emails", len(sentEmails))
+	}
+}
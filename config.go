@@ -2,8 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -22,16 +25,114 @@ type Config struct {
 	AwsRegion string `toml:"aws_region"`
 	Bucket    Bucket `toml:"bucket"`
 
+	Policy Policy `toml:"policy"`
+
 	Routes []Route `toml:"route"`
+
+	Sieve Sieve `toml:"sieve"`
+
+	Digest DigestSchedule `toml:"digest"`
+
+	VIP VIP `toml:"vip"`
+
+	Groups []Group `toml:"group"`
+
+	Destinations []Destination `toml:"destination"`
+
+	ProxyDomains []ProxyDomain `toml:"proxy_domain"`
+
+	Quota Quota `toml:"quota"`
+
+	Aliases AliasRegistry `toml:"aliases"`
+
+	Tenants Tenants `toml:"tenants"`
+
+	sieve *sieveScript
+	// routes is the compiled route table in evaluation order. It is
+	// built by compile and not modified afterwards.
+	routes []Route
+	// domains are the compiled configs for ProxyDomains and
+	// domainNames the lower cased names of every domain we handle.
+	domains     []*Config
+	domainNames []string
+	// tenants are the configs loaded by loadTenants.
+	tenants []*Config
 }
 
 type Route struct {
-	Src                  string `toml:"src"`
-	Dst                  string `toml:"dst"`
-	SNS                  string `toml:"sns"`
-	Forward              bool   `toml:"forward"`
-	AllowSuspectMessages bool   `toml:"allow_suspect_messages"`
-	Drop                 bool   `toml:"drop"`
+	// Name identifies the route in logs and archive tags.
+	Name string `toml:"name"`
+
+	Condition
+
+	// Recipients selects which recipients dst is matched against:
+	// to (the default), cc, bcc, envelope or any.
+	Recipients string `toml:"recipients"`
+
+	SNS                  string     `toml:"sns"`
+	SQS                  []string   `toml:"sqs"`
+	Lambda               []string   `toml:"lambda"`
+	Webhook              []Webhook  `toml:"webhook"`
+	Forward              bool       `toml:"forward"`
+	AllowSuspectMessages bool       `toml:"allow_suspect_messages"`
+	Drop                 bool       `toml:"drop"`
+	Bounce               *Bounce    `toml:"bounce"`
+	Autoreply            *Autoreply `toml:"autoreply"`
+	Archive              *Archive   `toml:"archive"`
+	Feed                 *Feed      `toml:"feed"`
+	Extract              *Extract   `toml:"extract"`
+	// Digest is "hourly" or "daily" to add the message to the next
+	// digest of that schedule.
+	Digest      string       `toml:"digest"`
+	Attachments *Attachments `toml:"attachments"`
+	Policy      Policy       `toml:"policy"`
+
+	// Priority orders route evaluation. Routes with a higher
+	// priority are evaluated first; routes with equal priority are
+	// evaluated in file order.
+	Priority int `toml:"priority"`
+	// Stop ends route evaluation after this route matches. By
+	// default evaluation continues with the next route.
+	Stop bool `toml:"stop"`
+}
+
+// Condition is a set of tests against a message. Every test that
+// is set must match. All, Any and Not nest further conditions:
+// every condition in All must match, at least one condition in Any
+// must match and Not must not match.
+type Condition struct {
+	Src     string        `toml:"src"`
+	Dst     string        `toml:"dst"`
+	Subject string        `toml:"subject"`
+	Header  []HeaderMatch `toml:"header"`
+	Body    string        `toml:"body"`
+
+	All []Condition `toml:"all"`
+	Any []Condition `toml:"any"`
+	Not *Condition  `toml:"not"`
+
+	// set by compile
+	compiled bool
+	src      *pattern
+	dst      *pattern
+	subject  *pattern
+	body     *pattern
+}
+
+// Sieve configures an optional sieve script that runs after routes.
+// The script can either be inline or stored in the message bucket.
+type Sieve struct {
+	Script string `toml:"script"`
+	S3Key  string `toml:"s3_key"`
+}
+
+// HeaderMatch matches a message header by name. If Value is empty
+// the header only needs to be present.
+type HeaderMatch struct {
+	Name  string `toml:"name"`
+	Value string `toml:"value"`
+
+	value *pattern
 }
 
 type Bucket struct {
@@ -39,6 +140,13 @@ type Bucket struct {
 	MsgPrefix         string `toml:"msg_prefix"`
 	ForwardMetaPrefix string `toml:"forward_meta_prefix"`
 	OutboxPrefix      string `toml:"outbox_prefix"`
+	QuarantinePrefix  string `toml:"quarantine_prefix"`
+	AutoreplyPrefix   string `toml:"autoreply_prefix"`
+	DigestPrefix      string `toml:"digest_prefix"`
+	QuotaPrefix       string `toml:"quota_prefix"`
+	AliasPrefix       string `toml:"alias_prefix"`
+	FeedPrefix        string `toml:"feed_prefix"`
+	AttachmentPrefix  string `toml:"attachment_prefix"`
 }
 
 func (c *Config) PrivateAccountDomain() string {
@@ -51,6 +159,99 @@ func (c *Config) PrivateAccountMailbox() string {
 	return parts[0]
 }
 
+const defaultQuarantinePrefix = "/quarantine"
+
+func (c *Config) QuarantinePrefix() string {
+	if c.Bucket.QuarantinePrefix == "" {
+		return defaultQuarantinePrefix
+	}
+	return c.Bucket.QuarantinePrefix
+}
+
+// compile builds the route table: every route pattern is compiled
+// and the routes are sorted into evaluation order, highest priority
+// first, then file order. Each proxy domain gets its own compiled
+// config.
+func (c *Config) compile() error {
+	if err := c.compileDomain(); err != nil {
+		return err
+	}
+	if err := c.VIP.compile(); err != nil {
+		return err
+	}
+
+	c.domainNames = []string{strings.ToLower(c.Domain)}
+	for _, d := range c.ProxyDomains {
+		c.domainNames = append(c.domainNames, strings.ToLower(d.Domain))
+	}
+
+	c.domains = nil
+	for i := range c.ProxyDomains {
+		dc, err := c.ProxyDomains[i].config(fmt.Sprintf("proxy_domain[%d]", i), c)
+		if err != nil {
+			return err
+		}
+		c.domains = append(c.domains, dc)
+	}
+	return nil
+}
+
+// compileDomain compiles the settings that depend on the domain.
+func (c *Config) compileDomain() error {
+	routes := make([]Route, len(c.Routes))
+	for i, r := range c.Routes {
+		name := fmt.Sprintf("route[%d]", i)
+		cond, err := r.Condition.compile(name, c.PrivateAccountAddress)
+		if err != nil {
+			return err
+		}
+		if !r.hasActions() {
+			return fmt.Errorf("%s: route has no actions", name)
+		}
+		if r.Autoreply != nil {
+			if err := r.Autoreply.compile(); err != nil {
+				return fmt.Errorf("%s.autoreply: %w", name, err)
+			}
+		}
+		if r.Archive != nil {
+			if err := r.Archive.compile(); err != nil {
+				return fmt.Errorf("%s.archive.prefix: %w", name, err)
+			}
+		}
+		if r.Attachments != nil {
+			if err := r.Attachments.compile(); err != nil {
+				return fmt.Errorf("%s.attachments.key: %w", name, err)
+			}
+		}
+		if r.Extract != nil {
+			if err := r.Extract.compile(); err != nil {
+				return fmt.Errorf("%s.extract.%w", name, err)
+			}
+		}
+		r.Condition = cond
+		routes[i] = r
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority > routes[j].Priority
+	})
+	c.routes = routes
+
+	for i := range c.Destinations {
+		if err := c.Destinations[i].compile(fmt.Sprintf("destination[%d]", i), c.Domain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasActions reports whether matching the route has any effect.
+func (r *Route) hasActions() bool {
+	return r.SNS != "" || len(r.SQS) > 0 || len(r.Lambda) > 0 || len(r.Webhook) > 0 ||
+		r.Drop || r.Bounce != nil || r.Autoreply != nil || r.Archive != nil || r.Attachments != nil || r.Feed != nil || r.Extract != nil || r.Digest != "" || !r.Forward || r.Stop || r.Policy != (Policy{})
+}
+
 func loadCloudConfig(lgr log15.Logger) *Config {
 	bucketName := os.Getenv("S3_CONFIG_BUCKET")
 	confPath := os.Getenv("S3_CONFIG_PATH")
@@ -83,6 +284,15 @@ func loadCloudConfig(lgr log15.Logger) *Config {
 		return nil
 	}
 
+	err = conf.validate()
+	if err != nil {
+		lgr.Error("invalid_config", "err", err)
+		return nil
+	}
+	if w := conf.digestLinkWarning(); w != "" {
+		lgr.Warn("digest_link_expiry", "warning", w)
+	}
+
 	return &conf
 }
 
@@ -112,6 +322,9 @@ func loadLocalConfig() *Config {
 	if err != nil {
 		panic(err)
 	}
+	if w := conf.digestLinkWarning(); w != "" {
+		log15.New().Warn("digest_link_expiry", "warning", w)
+	}
 
 	return &conf
 }
@@ -145,5 +358,276 @@ func (c *Config) validate() error {
 		return errors.New("bucket.outbox_prefix must be set")
 	}
 
+	if err := c.Policy.validate("policy"); err != nil {
+		return err
+	}
+
+	if err := c.Digest.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Quota.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Aliases.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tenants.validate(); err != nil {
+		return err
+	}
+
+	domains := map[string]bool{strings.ToLower(c.Domain): true}
+	digestPrefixes := map[string]string{path.Clean(c.DigestPrefix()): c.Domain}
+	for i, d := range c.ProxyDomains {
+		name := fmt.Sprintf("proxy_domain[%d]", i)
+		if err := d.validate(name); err != nil {
+			return err
+		}
+		if domains[strings.ToLower(d.Domain)] {
+			return fmt.Errorf("%s: duplicate domain %s", name, d.Domain)
+		}
+		domains[strings.ToLower(d.Domain)] = true
+
+		// a shared digest prefix would send each domain's digests
+		// from every domain
+		prefix := path.Clean(d.digestPrefix(c))
+		if other, ok := digestPrefixes[prefix]; ok {
+			return fmt.Errorf("%s.bucket.digest_prefix: %s is already used by %s", name, prefix, other)
+		}
+		digestPrefixes[prefix] = d.Domain
+	}
+
+	// mail can only be received and sent on our own domains
+	if !domains[domainOf(c.OutboundAddress)] {
+		return fmt.Errorf("outbound_address must be on a configured domain")
+	}
+
+	// forwarding to any of our domains would loop back through the
+	// lambda
+	if domains[domainOf(c.PrivateAccountAddress)] {
+		return fmt.Errorf("private_address must not be on a configured domain")
+	}
+	for i, d := range c.ProxyDomains {
+		if domains[domainOf(d.PrivateAccountAddress)] {
+			return fmt.Errorf("proxy_domain[%d].private_address must not be on a configured domain", i)
+		}
+	}
+
+	for i, d := range c.Destinations {
+		if err := d.validate(fmt.Sprintf("destination[%d]", i), domains); err != nil {
+			return err
+		}
+	}
+
+	groups := make(map[string]bool)
+	for i, g := range c.Groups {
+		if err := g.validate(fmt.Sprintf("group[%d]", i), domains); err != nil {
+			return err
+		}
+		local := strings.ToLower(strings.SplitN(g.Alias, "@", 2)[0])
+		if groups[local] {
+			return fmt.Errorf("group[%d]: duplicate alias %s", i, g.Alias)
+		}
+		groups[local] = true
+	}
+
+	if err := validateRoutes("route", c.Routes, domains); err != nil {
+		return err
+	}
+	for i, d := range c.ProxyDomains {
+		if err := validateRoutes(fmt.Sprintf("proxy_domain[%d].route", i), d.Routes, domains); err != nil {
+			return err
+		}
+	}
+
+	if err := c.compile(); err != nil {
+		return err
+	}
+
+	if c.Sieve.Script != "" && c.Sieve.S3Key != "" {
+		return errors.New("sieve.script and sieve.s3_key are mutually exclusive")
+	}
+	if c.Sieve.Script != "" {
+		if _, err := parseSieve(c.Sieve.Script); err != nil {
+			return fmt.Errorf("sieve.script: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// loadSieve parses the configured sieve script, fetching it from the
+// message bucket if sieve.s3_key is set.
+func (c *Config) loadSieve() error {
+	script := c.Sieve.Script
+	if c.Sieve.S3Key != "" {
+		obj, err := s3GetObj(&s3.GetObjectInput{
+			Bucket: &c.Bucket.Name,
+			Key:    &c.Sieve.S3Key,
+		})
+		if err != nil {
+			return fmt.Errorf("fetch sieve script %s err: %w", c.Sieve.S3Key, err)
+		}
+		defer obj.Body.Close()
+
+		b, err := ioutil.ReadAll(obj.Body)
+		if err != nil {
+			return fmt.Errorf("read sieve script %s err: %w", c.Sieve.S3Key, err)
+		}
+		script = string(b)
+	}
+
+	if script == "" {
+		return nil
+	}
+
+	parsed, err := parseSieve(script)
+	if err != nil {
+		return err
+	}
+	c.sieve = parsed
+	for _, dc := range c.domains {
+		dc.sieve = parsed
+	}
+	return nil
+}
+
+func (c *Condition) isEmpty() bool {
+	return c.Src == "" && c.Dst == "" && c.Subject == "" && len(c.Header) == 0 && c.Body == "" &&
+		len(c.All) == 0 && len(c.Any) == 0 && c.Not == nil
+}
+
+// compile returns a copy of c with its patterns compiled, checking
+// that c and every nested condition tests at least one field.
+// privateAddr replaces the __PRIVATE_ADDRESS__ placeholder in src
+// and dst.
+func (c *Condition) compile(name, privateAddr string) (Condition, error) {
+	out := *c
+	if c.isEmpty() {
+		return out, fmt.Errorf("%s: condition must test at least one field", name)
+	}
+
+	src, dst := c.Src, c.Dst
+	if src == privateAddrPlaceholder {
+		src = privateAddr
+	}
+	if dst == privateAddrPlaceholder {
+		dst = privateAddr
+	}
+
+	var err error
+	for _, f := range []struct {
+		text string
+		p    **pattern
+	}{
+		{src, &out.src},
+		{dst, &out.dst},
+		{c.Subject, &out.subject},
+		{c.Body, &out.body},
+	} {
+		*f.p, err = compilePattern(f.text)
+		if err != nil {
+			return out, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	out.Header = make([]HeaderMatch, len(c.Header))
+	for i, h := range c.Header {
+		if h.Name == "" {
+			return out, fmt.Errorf("%s: header.name must be set", name)
+		}
+		h.value, err = compilePattern(h.Value)
+		if err != nil {
+			return out, fmt.Errorf("%s: %w", name, err)
+		}
+		out.Header[i] = h
+	}
+
+	out.All = make([]Condition, len(c.All))
+	for i := range c.All {
+		out.All[i], err = c.All[i].compile(fmt.Sprintf("%s.all[%d]", name, i), privateAddr)
+		if err != nil {
+			return out, err
+		}
+	}
+	out.Any = make([]Condition, len(c.Any))
+	for i := range c.Any {
+		out.Any[i], err = c.Any[i].compile(fmt.Sprintf("%s.any[%d]", name, i), privateAddr)
+		if err != nil {
+			return out, err
+		}
+	}
+	if c.Not != nil {
+		not, err := c.Not.compile(name+".not", privateAddr)
+		if err != nil {
+			return out, err
+		}
+		out.Not = &not
+	}
+
+	out.compiled = true
+	return out, nil
+}
+
+// validateRoutes checks the route table named name. domains are the
+// lower cased domains mail may be sent from.
+func validateRoutes(name string, routes []Route, domains map[string]bool) error {
+	for i, r := range routes {
+		switch r.Recipients {
+		case "", recipientsTo, recipientsCc, recipientsBcc, recipientsEnvelope, recipientsAny:
+		default:
+			return fmt.Errorf("%s[%d].recipients: unknown recipient set %q", name, i, r.Recipients)
+		}
+		if err := r.Policy.validate(fmt.Sprintf("%s[%d].policy", name, i)); err != nil {
+			return err
+		}
+		if !s3TagValueRe.MatchString(r.Name) || len(r.Name) > 256 {
+			return fmt.Errorf("%s[%d].name: may only contain letters, numbers, spaces and _.:/=+-@", name, i)
+		}
+		if r.Attachments != nil {
+			if err := r.Attachments.validate(fmt.Sprintf("%s[%d].attachments", name, i)); err != nil {
+				return err
+			}
+		}
+		switch r.Digest {
+		case "", digestHourly, digestDaily:
+		default:
+			return fmt.Errorf("%s[%d].digest must be %q or %q", name, i, digestHourly, digestDaily)
+		}
+		if r.Feed != nil {
+			if err := r.Feed.validate(fmt.Sprintf("%s[%d].feed", name, i), r.Name); err != nil {
+				return err
+			}
+		}
+		if r.Archive != nil {
+			if err := r.Archive.validate(fmt.Sprintf("%s[%d].archive", name, i)); err != nil {
+				return err
+			}
+		}
+		if r.Autoreply != nil {
+			if err := r.Autoreply.validate(fmt.Sprintf("%s[%d].autoreply", name, i)); err != nil {
+				return err
+			}
+		}
+		if r.Bounce != nil {
+			if r.Drop {
+				return fmt.Errorf("%s[%d]: drop and bounce are mutually exclusive", name, i)
+			}
+			if err := r.Bounce.validate(fmt.Sprintf("%s[%d].bounce", name, i)); err != nil {
+				return err
+			}
+			if r.Bounce.Sender != "" && !domains[domainOf(r.Bounce.Sender)] {
+				return fmt.Errorf("%s[%d].bounce.sender must be on a configured domain", name, i)
+			}
+		}
+		for j, wh := range r.Webhook {
+			if err := wh.validate(fmt.Sprintf("%s[%d].webhook[%d]", name, i, j)); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
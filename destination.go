@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	gomail "net/mail"
+	"strings"
+)
+
+// Destination forwards messages for matching aliases to Address
+// instead of the private address. Aliases are local parts, full
+// addresses or regular expressions wrapped in slashes matched
+// against the full alias address. The first matching destination
+// wins.
+type Destination struct {
+	Aliases []string `toml:"aliases"`
+	Address string   `toml:"address"`
+
+	aliases []*pattern
+}
+
+func (d *Destination) validate(name string, domains map[string]bool) error {
+	if len(d.Aliases) == 0 {
+		return fmt.Errorf("%s.aliases must be set", name)
+	}
+	addr, err := gomail.ParseAddress(d.Address)
+	if err != nil {
+		return fmt.Errorf("%s.address: invalid address %q", name, d.Address)
+	}
+	if addr.Address != d.Address {
+		return fmt.Errorf("%s.address must be a bare address like %s", name, addr.Address)
+	}
+	// forwarding to one of our domains would loop back through the
+	// lambda
+	if domains[domainOf(addr.Address)] {
+		return fmt.Errorf("%s.address must not be on %s", name, domainOf(addr.Address))
+	}
+	return nil
+}
+
+// compile compiles the alias patterns, qualifying bare local parts
+// with domain.
+func (d *Destination) compile(name, domain string) error {
+	d.aliases = nil
+	for i, alias := range d.Aliases {
+		if alias != "" && !strings.HasPrefix(alias, "/") {
+			if !strings.Contains(alias, "@") {
+				alias = alias + "@" + domain
+			}
+			alias = strings.ToLower(alias)
+		}
+		p, err := compilePattern(alias)
+		if err != nil {
+			return fmt.Errorf("%s.aliases[%d]: %w", name, i, err)
+		}
+		if p != nil {
+			d.aliases = append(d.aliases, p)
+		}
+	}
+	return nil
+}
+
+func (d *Destination) match(proxyAddr string) bool {
+	for _, p := range d.aliases {
+		if p.matchAddr(proxyAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// destination returns the address messages to proxyAddr are
+// forwarded to.
+func (c *Config) destination(proxyAddr string) string {
+	proxyAddr = strings.ToLower(proxyAddr)
+	for i := range c.Destinations {
+		if c.Destinations[i].match(proxyAddr) {
+			return c.Destinations[i].Address
+		}
+	}
+	return c.PrivateAccountAddress
+}
+
+// isDestination reports whether addr is the private address or one
+// of the destination addresses.
+func (c *Config) isDestination(addr string) bool {
+	if strings.EqualFold(addr, c.PrivateAccountAddress) {
+		return true
+	}
+	for _, d := range c.Destinations {
+		if strings.EqualFold(addr, d.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagAddr returns dest with tag appended to the mailbox as a +tag.
+func tagAddr(dest, tag string) string {
+	sanitized := replaceRegex.ReplaceAllString(tag, "_")
+	i := strings.LastIndex(dest, "@")
+	if i < 0 {
+		return dest + "+" + sanitized
+	}
+	return dest[:i] + "+" + sanitized + dest[i:]
+}
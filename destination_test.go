@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-test/deep"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestDestination(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Destinations: []Destination{
+			{Aliases: []string{"test"}, Address: "alice@mail.example.net"},
+			{Aliases: []string{"/^shop-.*@my-ses-email-domain\\.example\\.com$/", "bob@my-ses-email-domain.example.com"}, Address: "bob@mail.example.org"},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	destChecks := []struct {
+		alias  string
+		expect string
+	}{
+		{"test@my-ses-email-domain.example.com", "alice@mail.example.net"},
+		{"TEST@my-ses-email-domain.example.com", "alice@mail.example.net"},
+		{"shop-acme@my-ses-email-domain.example.com", "bob@mail.example.org"},
+		{"bob@my-ses-email-domain.example.com", "bob@mail.example.org"},
+		{"other@my-ses-email-domain.example.com", "foo@gmail.example.com"},
+	}
+	for _, check := range destChecks {
+		if got := conf.destination(check.alias); got != check.expect {
+			t.Errorf("destination(%s) got %s expected %s", check.alias, got, check.expect)
+		}
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessage(t, id, "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	sent := sentEmails[0]
+	if diff := deep.Equal(aws.StringValueSlice(sent.input.Destinations), []string{"alice+test@mail.example.net"}); diff != nil {
+		t.Errorf("forward destinations: %s", diff)
+	}
+
+	// the alias's destination can reply through the alias, whatever
+	// the case of its address
+	root, err := enmime.Builder().
+		From("Alice", "alice@mail.example.net").
+		To("", "test@my-ses-email-domain.example.com").
+		Subject("Re: save off header").
+		Header("In-Reply-To", "<"+sent.sendID+"@email.amazonses.com>").
+		Text([]byte("thanks")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := root.Encode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := loadTestEvent(t)
+	reply.Records[0].SES.Mail.MessageID = "alice-reply"
+	reply.Records[0].SES.Mail.CommonHeaders.From = []string{"Alice <Alice@Mail.Example.net>"}
+	putTestMessageBytes(t, "alice-reply", raw.Bytes())
+
+	sentEmails = nil
+
+	if err := Handler(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 reply email got %d", len(sentEmails))
+	}
+	if diff := deep.Equal(aws.StringValueSlice(sentEmails[0].input.Destinations), []string{"psanford@example.com"}); diff != nil {
+		t.Errorf("reply destinations: %s", diff)
+	}
+	if got := *sentEmails[0].input.Source; got != "test@my-ses-email-domain.example.com" {
+		t.Errorf("reply source got %s", got)
+	}
+
+	// the private address is an ordinary sender to an alias with
+	// another destination
+	private := loadTestEvent(t)
+	private.Records[0].SES.Mail.MessageID = "private-msg"
+	private.Records[0].SES.Mail.CommonHeaders.From = []string{"foo@gmail.example.com"}
+	putTestMessageBytes(t, "private-msg", raw.Bytes())
+
+	sentEmails = nil
+
+	if err := Handler(private); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	if diff := deep.Equal(aws.StringValueSlice(sentEmails[0].input.Destinations), []string{"alice+test@mail.example.net"}); diff != nil {
+		t.Errorf("private sender destinations: %s", diff)
+	}
+}
+
+func TestDestinationValidate(t *testing.T) {
+	checks := []struct {
+		name  string
+		d     Destination
+		valid bool
+	}{
+		{"ok", Destination{Aliases: []string{"alice"}, Address: "alice@example.com"}, true},
+		{"no_aliases", Destination{Address: "alice@example.com"}, false},
+		{"bad_address", Destination{Aliases: []string{"alice"}, Address: "alice"}, false},
+		{"named_address", Destination{Aliases: []string{"alice"}, Address: "Alice <alice@example.com>"}, false},
+		{"loop", Destination{Aliases: []string{"alice"}, Address: "other@my-ses-email-domain.example.com"}, false},
+		{"proxy_domain_loop", Destination{Aliases: []string{"alice"}, Address: "other@OTHER.example.org"}, false},
+	}
+
+	domains := map[string]bool{"my-ses-email-domain.example.com": true, "other.example.org": true}
+	for _, check := range checks {
+		err := check.d.validate("destination", domains)
+		if (err == nil) != check.valid {
+			t.Errorf("%s: valid=%t got err=%v", check.name, check.valid, err)
+		}
+	}
+
+	if got := tagAddr("alice@example.com", "shop.acme"); got != "alice+shop_acme@example.com" {
+		t.Errorf("tagAddr got %s", got)
+	}
+}
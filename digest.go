@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+
+	defaultDigestPrefix = "/digest"
+
+	digestSnippetLen = 200
+	// digestLinkTTL is the longest S3 allows for a presigned url.
+	// Links signed with the function's temporary credentials stop
+	// working when the credentials expire, which is usually sooner,
+	// so they can be signed with an IAM user's keys from
+	// DIGEST_LINK_ACCESS_KEY_ID and DIGEST_LINK_SECRET_ACCESS_KEY
+	// instead.
+	digestLinkTTL = 7 * 24 * time.Hour
+)
+
+// digestLinkCredentials returns the long lived credentials digest
+// links are signed with, or nil if they are not set in the
+// environment.
+func digestLinkCredentials() *credentials.Credentials {
+	id, secret := os.Getenv("DIGEST_LINK_ACCESS_KEY_ID"), os.Getenv("DIGEST_LINK_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil
+	}
+	return credentials.NewStaticCredentials(id, secret, "")
+}
+
+// digestLinkWarning returns a warning if c sends digests whose links
+// will be signed with the function's temporary credentials.
+func (c *Config) digestLinkWarning() string {
+	if digestLinkCredentials() != nil {
+		return ""
+	}
+	for _, dc := range append([]*Config{c}, c.domains...) {
+		for _, r := range dc.Routes {
+			if r.Digest != "" {
+				return "digest links are signed with the function's temporary credentials, which usually expire within hours, long before the next digest is read; set DIGEST_LINK_ACCESS_KEY_ID and DIGEST_LINK_SECRET_ACCESS_KEY to sign them with an IAM user's keys"
+			}
+		}
+	}
+	return ""
+}
+
+// DigestSchedule controls when batched digests are sent. The function
+// is expected to be invoked by an hourly CloudWatch scheduled event.
+// Daily digests are sent on the invocation in DailyHour. Hourly
+// digests are held during quiet hours, from QuietStart up to
+// QuietEnd, and sent on the first invocation after. Hours are in
+// TimeZone, which defaults to UTC.
+type DigestSchedule struct {
+	TimeZone   string `toml:"timezone"`
+	DailyHour  int    `toml:"daily_hour"`
+	QuietStart int    `toml:"quiet_start"`
+	QuietEnd   int    `toml:"quiet_end"`
+}
+
+func (d *DigestSchedule) validate() error {
+	if _, err := time.LoadLocation(d.TimeZone); err != nil {
+		return fmt.Errorf("digest.timezone: %w", err)
+	}
+	for name, hour := range map[string]int{"daily_hour": d.DailyHour, "quiet_start": d.QuietStart, "quiet_end": d.QuietEnd} {
+		if hour < 0 || hour > 23 {
+			return fmt.Errorf("digest.%s must be between 0 and 23", name)
+		}
+	}
+	return nil
+}
+
+// quiet reports whether hour is within quiet hours. Quiet hours may
+// wrap past midnight; equal start and end means there are none.
+func (d *DigestSchedule) quiet(hour int) bool {
+	switch {
+	case d.QuietStart == d.QuietEnd:
+		return false
+	case d.QuietStart < d.QuietEnd:
+		return hour >= d.QuietStart && hour < d.QuietEnd
+	default:
+		return hour >= d.QuietStart || hour < d.QuietEnd
+	}
+}
+
+// due returns the digests to send at t.
+func (d *DigestSchedule) due(t time.Time) ([]string, error) {
+	loc, err := time.LoadLocation(d.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	hour := t.In(loc).Hour()
+
+	var due []string
+	if !d.quiet(hour) {
+		due = append(due, digestHourly)
+	}
+	if hour == d.DailyHour {
+		due = append(due, digestDaily)
+	}
+	return due, nil
+}
+
+func (c *Config) DigestPrefix() string {
+	if c.Bucket.DigestPrefix == "" {
+		return defaultDigestPrefix
+	}
+	return c.Bucket.DigestPrefix
+}
+
+// digestEntry is the reference stored for each message waiting for a
+// digest.
+type digestEntry struct {
+	ID       string    `json:"id"`
+	Route    string    `json:"route"`
+	To       string    `json:"to"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	Date     string    `json:"date"`
+	Received time.Time `json:"received"`
+	Snippet  string    `json:"snippet"`
+}
+
+func digestEntryKey(schedule string, received time.Time, id string) string {
+	return path.Join(conf.DigestPrefix(), schedule, received.UTC().Format("20060102T150405Z")+"-"+id+".json")
+}
+
+// addToDigest stores a reference to the message for the next digest
+// on schedule.
+func addToDigest(schedule, route string, record events.SimpleEmailRecord, body *enmime.Envelope) error {
+	mail := record.SES.Mail
+
+	entry := digestEntry{
+		ID:       mail.MessageID,
+		Route:    route,
+		To:       proxyRecipient(record),
+		From:     strings.Join(mail.CommonHeaders.From, ", "),
+		Subject:  mail.CommonHeaders.Subject,
+		Date:     mail.CommonHeaders.Date,
+		Received: mail.Timestamp,
+		Snippet:  snippet(body.Text, digestSnippetLen),
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := digestEntryKey(schedule, mail.Timestamp, mail.MessageID)
+	_, err = s3PutObj(&s3manager.UploadInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+		Body:   bytes.NewReader(b),
+	})
+	if err != nil {
+		return fmt.Errorf("save digest entry %s err: %w", key, err)
+	}
+	return nil
+}
+
+// snippet returns the first n characters of text with whitespace
+// collapsed.
+func snippet(text string, n int) string {
+	s := []rune(strings.Join(strings.Fields(text), " "))
+	if len(s) <= n {
+		return string(s)
+	}
+	return strings.TrimSpace(string(s[:n])) + "..."
+}
+
+// ScheduledHandler sends the digests that are due at the time of a
+// CloudWatch scheduled event.
+func ScheduledHandler(ev events.CloudWatchEvent) error {
+	if err := setup(); err != nil {
+		return err
+	}
+
+	lgr := log15.New("scheduled_event", ev.ID, "time", ev.Time)
+
+	root := conf
+	defer func() {
+		conf = root
+	}()
+
+	var errors []error
+	for _, dc := range root.all() {
+		conf = dc
+		due, err := dc.Digest.due(ev.Time)
+		if err != nil {
+			lgr.Error("digest_schedule_err", "domain", dc.Domain, "err", err)
+			errors = append(errors, err)
+			continue
+		}
+		lgr.Info("digests_due", "domain", dc.Domain, "schedules", due)
+		for _, schedule := range due {
+			if err := sendDigest(lgr.New("domain", dc.Domain, "schedule", schedule), schedule); err != nil {
+				lgr.Error("send_digest_err", "domain", dc.Domain, "schedule", schedule, "err", err)
+				errors = append(errors, err)
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%+v", errors)
+	}
+	return nil
+}
+
+// sendDigest emails the pending entries for schedule and removes
+// them. Each entry goes to the destination of the alias the message
+// was sent to, with one digest per destination.
+func sendDigest(lgr log15.Logger, schedule string) error {
+	keys, err := listKeys(path.Join(conf.DigestPrefix(), schedule) + "/")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		lgr.Info("digest_empty")
+		return nil
+	}
+
+	var (
+		dests   []string
+		pending = make(map[string][]pendingDigestEntry)
+	)
+	for _, key := range keys {
+		entry, err := getDigestEntry(key)
+		if err != nil {
+			return err
+		}
+		dest := conf.destination(entry.To)
+		if _, ok := pending[dest]; !ok {
+			dests = append(dests, dest)
+		}
+		pending[dest] = append(pending[dest], pendingDigestEntry{key: key, entry: entry})
+	}
+
+	for _, dest := range dests {
+		if err := sendDigestTo(lgr.New("to", dest), schedule, dest, pending[dest]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingDigestEntry is a digest entry and its key.
+type pendingDigestEntry struct {
+	key   string
+	entry digestEntry
+}
+
+// sendDigestTo emails the entries to dest and removes them.
+func sendDigestTo(lgr log15.Logger, schedule, dest string, entries []pendingDigestEntry) error {
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "%d messages since the last %s digest.\n", len(entries), schedule)
+
+	for _, p := range entries {
+		entry := p.entry
+
+		url, ttl, err := presignKeyFor(path.Join(conf.Bucket.MsgPrefix, entry.ID), digestLinkTTL, digestLinkCredentials())
+		if err != nil {
+			return fmt.Errorf("presign url for %s err: %w", entry.ID, err)
+		}
+		if ttl < digestLinkTTL {
+			lgr.Warn("digest_link_ttl_shortened", "msg_id", entry.ID, "ttl", ttl, "credentials_expire", time.Now().Add(ttl).Format(time.RFC3339))
+		}
+
+		fmt.Fprintf(&text, "\nFrom: %s\nTo: %s\nSubject: %s\nDate: %s\n", entry.From, entry.To, entry.Subject, entry.Date)
+		if entry.Snippet != "" {
+			fmt.Fprintf(&text, "%s\n", entry.Snippet)
+		}
+		fmt.Fprintf(&text, "%s\n", url)
+	}
+
+	from := "digest@" + conf.Domain
+	b := enmime.Builder()
+	b = b.From("", from)
+	b = b.To("", dest)
+	b = b.Subject(fmt.Sprintf("%s digest: %d messages", strings.ToUpper(schedule[:1])+schedule[1:], len(entries)))
+	b = b.Text(text.Bytes())
+
+	root, err := b.Build()
+	if err != nil {
+		return fmt.Errorf("Build digest email err=%q", err)
+	}
+
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		return fmt.Errorf("Encode digest email err=%q", err)
+	}
+
+	_, err = sendEmail(&ses.SendRawEmailInput{
+		Destinations: strList([]string{dest}),
+		RawMessage: &ses.RawMessage{
+			Data: buf.Bytes(),
+		},
+		Source: &from,
+	})
+	if err != nil {
+		return fmt.Errorf("send digest error: %s", err)
+	}
+
+	lgr.Info("digest_sent", "messages", len(entries))
+
+	for _, p := range entries {
+		key := p.key
+		_, err := s3DeleteObj(&s3.DeleteObjectInput{
+			Bucket: &conf.Bucket.Name,
+			Key:    &key,
+		})
+		if err != nil {
+			return fmt.Errorf("delete digest entry %s err: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func getDigestEntry(key string) (digestEntry, error) {
+	var entry digestEntry
+
+	obj, err := s3GetObj(&s3.GetObjectInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+	})
+	if err != nil {
+		return entry, fmt.Errorf("get digest entry %s err: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	b, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return entry, fmt.Errorf("read digest entry %s err: %w", key, err)
+	}
+
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return entry, fmt.Errorf("decode digest entry %s err: %w", key, err)
+	}
+	return entry, nil
+}
+
+// listKeys returns the keys in the message bucket under prefix, in
+// lexical order.
+func listKeys(prefix string) ([]string, error) {
+	var (
+		keys   []string
+		marker *string
+	)
+	for {
+		out, err := s3ListObjs(&s3.ListObjectsInput{
+			Bucket: &conf.Bucket.Name,
+			Prefix: &prefix,
+			Marker: marker,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list %s err: %w", prefix, err)
+		}
+		for _, obj := range out.Contents {
+			keys = append(keys, *obj.Key)
+		}
+		if out.IsTruncated == nil || !*out.IsTruncated || len(out.Contents) == 0 {
+			return keys, nil
+		}
+		marker = out.Contents[len(out.Contents)-1].Key
+	}
+}
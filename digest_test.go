@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-test/deep"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestDigest(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Digest: DigestSchedule{
+			DailyHour:  8,
+			QuietStart: 22,
+			QuietEnd:   7,
+		},
+		Routes: []Route{
+			{
+				Name:      "low-priority",
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				Digest:    digestDaily,
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3DeleteObj = fakeDeleteObj
+	s3GetObjReq = fakeGetObjReq
+	s3ListObjs = fakeListObjs
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessage(t, id, "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 0 {
+		t.Fatalf("expected digest message not to be forwarded")
+	}
+	keys, err := listKeys("/digest/daily/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !strings.HasSuffix(keys[0], "-"+id+".json") {
+		t.Fatalf("unexpected digest entries %v", keys)
+	}
+
+	scheduled := func(ts string) []byte {
+		return []byte(`{"id":"cdc73f9d-aea9-11e3-9d5a-835b769c0d9c","detail-type":"Scheduled Event","source":"aws.events","time":"` + ts + `","region":"us-east-1","resources":["arn:aws:events:us-east-1:123456789012:rule/lambda-email-digest"],"detail":{}}`)
+	}
+
+	// 03:00 is in quiet hours and not the daily hour
+	if err := handleEvent(scheduled("2019-06-12T03:00:00Z")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 0 {
+		t.Fatalf("expected no digest during quiet hours got %d", len(sentEmails))
+	}
+
+	if err := handleEvent(scheduled("2019-06-12T08:00:00Z")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 digest email got %d", len(sentEmails))
+	}
+
+	sent := sentEmails[0]
+	if diff := deep.Equal(aws.StringValueSlice(sent.input.Destinations), []string{conf.PrivateAccountAddress}); diff != nil {
+		t.Errorf("digest destinations: %s", diff)
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(sent.input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.GetHeader("Subject"); got != "Daily digest: 1 messages" {
+		t.Errorf("digest subject got %q", got)
+	}
+	subject := sse.Records[0].SES.Mail.CommonHeaders.Subject
+	if !strings.Contains(env.Text, "Subject: "+subject) {
+		t.Errorf("digest missing message subject %q: %s", subject, env.Text)
+	}
+	if !strings.Contains(env.Text, "http://127.0.0.1") {
+		t.Errorf("digest missing presigned link: %s", env.Text)
+	}
+
+	keys, err = listKeys("/digest/daily/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected digest entries to be removed got %v", keys)
+	}
+}
+
+// TestDigestDestinations checks that digest entries are sent to the
+// destination of the alias each message was sent to.
+func TestDigestDestinations(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			DigestPrefix:      "/digest-destinations",
+		},
+		Digest: DigestSchedule{DailyHour: 8},
+		Destinations: []Destination{
+			{Aliases: []string{"test"}, Address: "alice@mail.example.net"},
+		},
+		Routes: []Route{
+			{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, Digest: digestDaily},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3DeleteObj = fakeDeleteObj
+	s3GetObjReq = fakeGetObjReq
+	s3ListObjs = fakeListObjs
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	for _, recipient := range []string{"test@my-ses-email-domain.example.com", "other@my-ses-email-domain.example.com"} {
+		sse := loadTestEvent(t)
+		sse.Records[0].SES.Mail.MessageID = "digest-dest-" + recipient
+		sse.Records[0].SES.Receipt.Recipients = []string{recipient}
+		putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+		if err := Handler(sse); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sentEmails = nil
+
+	if err := ScheduledHandler(events.CloudWatchEvent{ID: "digest", Time: time.Date(2019, 6, 12, 8, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 2 {
+		t.Fatalf("expected 1 digest per destination got %d", len(sentEmails))
+	}
+	for _, sent := range sentEmails {
+		to := aws.StringValueSlice(sent.input.Destinations)
+		expect := "To: other@my-ses-email-domain.example.com"
+		if len(to) == 1 && to[0] == "alice@mail.example.net" {
+			expect = "To: test@my-ses-email-domain.example.com"
+		}
+		env, err := enmime.ReadEnvelope(bytes.NewReader(sent.input.RawMessage.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(env.Text, "1 messages since") || !strings.Contains(env.Text, expect) {
+			t.Errorf("digest to %v should only list %s:\n%s", to, expect, env.Text)
+		}
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	d := DigestSchedule{TimeZone: "America/Los_Angeles", DailyHour: 7, QuietStart: 22, QuietEnd: 6}
+
+	checks := []struct {
+		utc    string
+		expect []string
+	}{
+		// 07:00 in Los Angeles
+		{"2021-07-01T14:00:00Z", []string{digestHourly, digestDaily}},
+		// 23:00
+		{"2021-07-02T06:00:00Z", nil},
+		// 05:00
+		{"2021-07-02T12:00:00Z", nil},
+		// 06:00
+		{"2021-07-02T13:00:00Z", []string{digestHourly}},
+	}
+
+	for _, check := range checks {
+		ts, err := time.Parse(time.RFC3339, check.utc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		due, err := d.due(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(due, check.expect); diff != nil {
+			t.Errorf("%s: %s", check.utc, diff)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ProxyDomain is an additional domain handled by the same
+// deployment. Each domain has its own outbound address, routes and
+// digest prefix. The private address and other bucket settings
+// default to the top level ones; policy, sieve, digest schedule, vip,
+// group and destination settings are shared by every domain.
+type ProxyDomain struct {
+	Domain                string `toml:"domain"`
+	PrivateAccountAddress string `toml:"private_address"`
+	OutboundAddress       string `toml:"outbound_address"`
+
+	Bucket Bucket `toml:"bucket"`
+
+	Routes []Route `toml:"route"`
+}
+
+func (d *ProxyDomain) validate(name string) error {
+	if d.Domain == "" {
+		return fmt.Errorf("%s.domain must be set", name)
+	}
+	if d.OutboundAddress == "" {
+		return fmt.Errorf("%s.outbound_address must be set", name)
+	}
+	if !strings.EqualFold(domainOf(d.OutboundAddress), d.Domain) {
+		return fmt.Errorf("%s.outbound_address must be on %s", name, d.Domain)
+	}
+	return nil
+}
+
+// config returns the config for d, based on the top level config c.
+func (d *ProxyDomain) config(name string, c *Config) (*Config, error) {
+	dc := *c
+	dc.Domain = d.Domain
+	if d.PrivateAccountAddress != "" {
+		dc.PrivateAccountAddress = d.PrivateAccountAddress
+	}
+	dc.OutboundAddress = d.OutboundAddress
+	dc.Bucket = d.Bucket.inherit(c.Bucket)
+	dc.Bucket.DigestPrefix = d.digestPrefix(c)
+	dc.Routes = d.Routes
+	// destinations qualify bare aliases with the domain when compiled
+	dc.Destinations = append([]Destination(nil), c.Destinations...)
+	dc.ProxyDomains = nil
+	dc.domains = nil
+
+	if err := dc.compileDomain(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &dc, nil
+}
+
+// digestPrefix returns the digest prefix for d. Digests are sent by
+// listing the prefix, so it defaults to the top level prefix followed
+// by the domain rather than the top level prefix itself.
+func (d *ProxyDomain) digestPrefix(c *Config) string {
+	if d.Bucket.DigestPrefix != "" {
+		return d.Bucket.DigestPrefix
+	}
+	return path.Join(c.DigestPrefix(), strings.ToLower(d.Domain))
+}
+
+// inherit returns b with unset fields taken from parent.
+func (b Bucket) inherit(parent Bucket) Bucket {
+	for _, f := range []struct {
+		field  *string
+		parent string
+	}{
+		{&b.Name, parent.Name},
+		{&b.MsgPrefix, parent.MsgPrefix},
+		{&b.ForwardMetaPrefix, parent.ForwardMetaPrefix},
+		{&b.OutboxPrefix, parent.OutboxPrefix},
+		{&b.QuarantinePrefix, parent.QuarantinePrefix},
+		{&b.AutoreplyPrefix, parent.AutoreplyPrefix},
+		{&b.DigestPrefix, parent.DigestPrefix},
+		{&b.QuotaPrefix, parent.QuotaPrefix},
+		{&b.AliasPrefix, parent.AliasPrefix},
+		{&b.FeedPrefix, parent.FeedPrefix},
+		{&b.AttachmentPrefix, parent.AttachmentPrefix},
+	} {
+		if *f.field == "" {
+			*f.field = f.parent
+		}
+	}
+	return b
+}
+
+// domainOf returns the lower cased domain of addr.
+func domainOf(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[i+1:], ">"))
+}
+
+// ownsAddress reports whether addr is on one of our domains. Proxy
+// domains are only known after compile.
+func (c *Config) ownsAddress(addr string) bool {
+	domain := domainOf(addr)
+	if domain == "" {
+		return false
+	}
+	if domain == strings.ToLower(c.Domain) {
+		return true
+	}
+	for _, d := range c.domainNames {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// forDomain returns the config for domain, or nil if it is not one
+// of our or our tenants' domains.
+func (c *Config) forDomain(domain string) *Config {
+	if strings.EqualFold(domain, c.Domain) {
+		return c
+	}
+	for _, dc := range c.domains {
+		if strings.EqualFold(domain, dc.Domain) {
+			return dc
+		}
+	}
+	for _, t := range c.tenants {
+		if dc := t.forDomain(domain); dc != nil {
+			return dc
+		}
+	}
+	return nil
+}
+
+// forRecord returns the config for the domain of the first
+// recipient of record on one of our or our tenants' domains. Records without such a
+// recipient get c.
+func (c *Config) forRecord(record events.SimpleEmailRecord) *Config {
+	for _, recipient := range record.SES.Receipt.Recipients {
+		if dc := c.forDomain(domainOf(recipient)); dc != nil {
+			return dc
+		}
+	}
+	return c
+}
+
+// all returns c followed by the config for each proxy domain and
+// tenant.
+func (c *Config) all() []*Config {
+	all := append([]*Config{c}, c.domains...)
+	for _, t := range c.tenants {
+		all = append(all, t.all()...)
+	}
+	return all
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-test/deep"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestProxyDomain(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{Condition: Condition{Dst: "/.*/"}, Drop: true},
+		},
+		ProxyDomains: []ProxyDomain{
+			{
+				Domain:                "other.example.org",
+				PrivateAccountAddress: "bar@mail.example.net",
+				OutboundAddress:       "outbound@other.example.org",
+				Bucket: Bucket{
+					MsgPrefix: "/other-email",
+				},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	b, err := os.ReadFile("test_data/msg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	sse.Records[0].SES.Receipt.Recipients = []string{"elsewhere@example.com", "Test@Other.example.org"}
+	fakeS3[bucketKey{"westerly-tapir", "/other-email/" + id}] = b
+
+	sentEmails = nil
+
+	root := conf
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if conf != root {
+		t.Errorf("expected Handler to restore conf")
+	}
+
+	// the top level drop route doesn't apply to the proxy domain
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	sent := sentEmails[0]
+	if diff := deep.Equal(aws.StringValueSlice(sent.input.Destinations), []string{"bar+test@mail.example.net"}); diff != nil {
+		t.Errorf("forward destinations: %s", diff)
+	}
+	if got := *sent.input.Source; got != "test@other.example.org" {
+		t.Errorf("forward source got %s", got)
+	}
+
+	sse = loadTestEvent(t)
+	putTestMessage(t, id, "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 0 {
+		t.Errorf("expected message to the top level domain to be dropped got %d emails", len(sentEmails))
+	}
+}
+
+func TestValidateProxyDomains(t *testing.T) {
+	base := Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "me@gmail.example.com",
+		OutboundAddress:       "outbound@my-ses-email-domain.example.com",
+		AwsRegion:             "us-east-1",
+		Bucket: Bucket{
+			Name:              "b",
+			MsgPrefix:         "/email",
+			ForwardMetaPrefix: "/meta",
+			OutboxPrefix:      "/outbox",
+		},
+	}
+	other := ProxyDomain{
+		Domain:          "other.example.org",
+		OutboundAddress: "outbound@other.example.org",
+	}
+	bounce := func(sender string) []Route {
+		return []Route{{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, Bounce: &Bounce{Sender: sender}}}
+	}
+
+	checks := []struct {
+		name  string
+		edit  func(c *Config)
+		valid bool
+	}{
+		{"ok", func(c *Config) {}, true},
+		{"no_domain", func(c *Config) {
+			c.ProxyDomains[0].Domain = ""
+		}, false},
+		{"duplicate", func(c *Config) {
+			c.ProxyDomains[0].Domain = "MY-SES-EMAIL-DOMAIN.example.com"
+			c.ProxyDomains[0].OutboundAddress = "outbound@my-ses-email-domain.example.com"
+		}, false},
+		{"outbound_elsewhere", func(c *Config) {
+			c.ProxyDomains[0].OutboundAddress = "outbound@my-ses-email-domain.example.com"
+		}, false},
+		{"top_outbound_on_proxy_domain", func(c *Config) {
+			c.OutboundAddress = "outbound@other.example.org"
+		}, true},
+		{"top_outbound_elsewhere", func(c *Config) {
+			c.OutboundAddress = "outbound@gmail.example.com"
+		}, false},
+		{"bounce_sender", func(c *Config) {
+			c.ProxyDomains[0].Routes = bounce("postmaster@my-ses-email-domain.example.com")
+		}, true},
+		{"bounce_sender_elsewhere", func(c *Config) {
+			c.ProxyDomains[0].Routes = bounce("postmaster@example.com")
+		}, false},
+		{"own_digest_prefix", func(c *Config) {
+			c.ProxyDomains[0].Bucket.DigestPrefix = "/other-digest"
+		}, true},
+		{"shared_digest_prefix", func(c *Config) {
+			c.ProxyDomains[0].Bucket.DigestPrefix = "/digest/"
+		}, false},
+		{"private_on_proxy_domain", func(c *Config) {
+			c.PrivateAccountAddress = "me@other.example.org"
+		}, false},
+		{"proxy_private_on_domain", func(c *Config) {
+			c.ProxyDomains[0].PrivateAccountAddress = "me@my-ses-email-domain.example.com"
+		}, false},
+		{"destination_on_proxy_domain", func(c *Config) {
+			c.Destinations = []Destination{{Aliases: []string{"alice"}, Address: "alice@other.example.org"}}
+		}, false},
+		{"member_on_proxy_domain", func(c *Config) {
+			c.Groups = []Group{{Alias: "family", Members: []string{"alice@other.example.org"}}}
+		}, false},
+		{"bad_route", func(c *Config) {
+			c.ProxyDomains[0].Routes = []Route{{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, Recipients: "reply-to"}}
+		}, false},
+	}
+
+	for _, check := range checks {
+		c := base
+		c.ProxyDomains = []ProxyDomain{other}
+		check.edit(&c)
+		err := c.validate()
+		if (err == nil) != check.valid {
+			t.Errorf("%s: valid=%t got err=%v", check.name, check.valid, err)
+		}
+	}
+
+	c := base
+	c.ProxyDomains = []ProxyDomain{other}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	dc := c.forDomain("other.example.org")
+	if dc == nil {
+		t.Fatal("expected a config for other.example.org")
+	}
+	expectBucket := c.Bucket
+	expectBucket.DigestPrefix = "/digest/other.example.org"
+	if dc.PrivateAccountAddress != c.PrivateAccountAddress || dc.Bucket != expectBucket {
+		t.Errorf("expected private address and bucket to default to the top level got %s %+v", dc.PrivateAccountAddress, dc.Bucket)
+	}
+}
+
+// TestProxyDomainDigest checks that each domain's digest only lists
+// the messages sent to that domain and goes to its private address.
+func TestProxyDomainDigest(t *testing.T) {
+	digestRoute := []Route{
+		{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, Digest: digestDaily},
+	}
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			DigestPrefix:      "/digest-domains",
+		},
+		Digest: DigestSchedule{DailyHour: 8},
+		Routes: digestRoute,
+		ProxyDomains: []ProxyDomain{
+			{
+				Domain:                "other.example.org",
+				PrivateAccountAddress: "bar@mail.example.net",
+				OutboundAddress:       "outbound@other.example.org",
+				Routes:                digestRoute,
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3DeleteObj = fakeDeleteObj
+	s3GetObjReq = fakeGetObjReq
+	s3ListObjs = fakeListObjs
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	var records []events.SimpleEmailRecord
+	for _, recipient := range []string{"test@my-ses-email-domain.example.com", "test@other.example.org"} {
+		sse := loadTestEvent(t)
+		record := sse.Records[0]
+		record.SES.Mail.MessageID = "digest-" + recipient
+		record.SES.Receipt.Recipients = []string{recipient}
+		putTestMessage(t, record.SES.Mail.MessageID, "test_data/msg0")
+		records = append(records, record)
+	}
+
+	sentEmails = nil
+
+	if err := Handler(events.SimpleEmailEvent{Records: records}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 0 {
+		t.Fatalf("expected digest messages not to be forwarded")
+	}
+
+	ev := events.CloudWatchEvent{ID: "digest", Time: time.Date(2019, 6, 12, 8, 0, 0, 0, time.UTC)}
+	if err := ScheduledHandler(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 2 {
+		t.Fatalf("expected 1 digest per domain got %d", len(sentEmails))
+	}
+	for _, sent := range sentEmails {
+		to := aws.StringValueSlice(sent.input.Destinations)
+		expect := "To: test@my-ses-email-domain.example.com"
+		if len(to) == 1 && to[0] == "bar@mail.example.net" {
+			expect = "To: test@other.example.org"
+		}
+		env, err := enmime.ReadEnvelope(bytes.NewReader(sent.input.RawMessage.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(env.Text, "1 messages since") || !strings.Contains(env.Text, expect) {
+			t.Errorf("digest to %v should only list %s:\n%s", to, expect, env.Text)
+		}
+	}
+}
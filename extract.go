@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+var (
+	defaultCodePatterns = []string{
+		`(?i)\b(?:code|pin|otp|passcode|token)\b[^0-9a-z]{0,10}(?:is[^0-9a-z]{1,10})?([0-9]{4,8}|[0-9]{3}[- ][0-9]{3})\b`,
+		`(?i)\b([0-9]{4,8}) is your\b`,
+	}
+	defaultLinkPatterns = []string{
+		`(?i)https?://[^\s"'<>]*(?:verif|confirm|activat|validat|magic|login|signin|sign-in|token)[^\s"'<>]*`,
+	}
+)
+
+// Extract pulls one-time codes and verification links out of the
+// message and adds them to the route payloads. Patterns are regular
+// expressions; if a pattern has a capture group the first group is
+// extracted, otherwise the whole match is. When SubjectPrefix is set
+// the first code is also prepended to the forwarded subject.
+type Extract struct {
+	CodePatterns  []string `toml:"code_patterns"`
+	LinkPatterns  []string `toml:"link_patterns"`
+	SubjectPrefix bool     `toml:"subject_prefix"`
+
+	// codeRes and linkRes are the compiled patterns, set by compile
+	codeRes []*regexp.Regexp
+	linkRes []*regexp.Regexp
+}
+
+// compile compiles the code and link patterns.
+func (e *Extract) compile() error {
+	codeRes, err := compileExtractPatterns(e.CodePatterns, defaultCodePatterns)
+	if err != nil {
+		return fmt.Errorf("code_patterns: %w", err)
+	}
+	linkRes, err := compileExtractPatterns(e.LinkPatterns, defaultLinkPatterns)
+	if err != nil {
+		return fmt.Errorf("link_patterns: %w", err)
+	}
+	e.codeRes, e.linkRes = codeRes, linkRes
+	return nil
+}
+
+func compileExtractPatterns(patterns, defaults []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		patterns = defaults
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// extracted is what an Extract found in a message.
+type extracted struct {
+	codes []string
+	links []string
+}
+
+func (x *extracted) merge(other extracted) {
+	for _, code := range other.codes {
+		x.codes = appendUnique(x.codes, code)
+	}
+	for _, link := range other.links {
+		x.links = appendUnique(x.links, link)
+	}
+}
+
+// extract returns the codes found in the subject and text body, and
+// the links found in the text and html bodies.
+func (e *Extract) extract(subject string, body *enmime.Envelope) (extracted, error) {
+	var x extracted
+
+	for _, s := range []string{subject, body.Text} {
+		for _, code := range findAll(e.codeRes, s) {
+			x.codes = appendUnique(x.codes, code)
+		}
+	}
+	for _, s := range []string{body.Text, html.UnescapeString(body.HTML)} {
+		for _, link := range findAll(e.linkRes, s) {
+			x.links = appendUnique(x.links, link)
+		}
+	}
+
+	return x, nil
+}
+
+func findAll(res []*regexp.Regexp, s string) []string {
+	var found []string
+	for _, re := range res {
+		for _, m := range re.FindAllStringSubmatch(s, -1) {
+			v := m[0]
+			if len(m) > 1 {
+				v = m[1]
+			}
+			if v = strings.TrimSpace(v); v != "" {
+				found = append(found, v)
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestExtract(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Name:      "signups",
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:codes",
+				Forward:   true,
+				Extract:   &Extract{SubjectPrefix: true},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3GetObjReq = fakeGetObjReq
+	snsPublish = fakeSNSPublish
+	defer func() {
+		snsMessages = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	root, err := enmime.Builder().
+		From("Example", "no-reply@example.com").
+		To("", "test@my-ses-email-domain.example.com").
+		Subject("Verify your account").
+		Text([]byte("Your verification code is 483920.\n\nOr visit https://example.com/verify?token=abc&u=1\n")).
+		HTML([]byte(`<p>Your verification code is <b>483920</b>.</p><a href="https://example.com/verify?token=abc&amp;u=1">Verify</a> <a href="https://example.com/unsubscribe">unsubscribe</a>`)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := root.Encode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessageBytes(t, id, raw.Bytes())
+
+	sentEmails = nil
+	snsMessages = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snsMessages) != 1 {
+		t.Fatalf("expected 1 sns publish got %d", len(snsMessages))
+	}
+	if diff := deep.Equal(snsMessages[0].Codes, []string{"483920"}); diff != nil {
+		t.Errorf("codes: %s", diff)
+	}
+	if diff := deep.Equal(snsMessages[0].Links, []string{"https://example.com/verify?token=abc&u=1"}); diff != nil {
+		t.Errorf("links: %s", diff)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[0].input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "483920 - " + sse.Records[0].SES.Mail.CommonHeaders.Subject
+	if got := env.GetHeader("Subject"); got != expect {
+		t.Errorf("forwarded subject got %q expected %q", got, expect)
+	}
+}
+
+func TestExtractPatterns(t *testing.T) {
+	checks := []struct {
+		name    string
+		subject string
+		text    string
+		codes   []string
+	}{
+		{"code_in_subject", "123456 is your login code", "", []string{"123456"}},
+		{"pin", "", "Your PIN: 8812", []string{"8812"}},
+		{"split_code", "", "Enter code 123-456 to continue", []string{"123-456"}},
+		{"no_code", "Your order has shipped", "Order 12345678 shipped", nil},
+	}
+
+	e := &Extract{}
+	if err := e.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range checks {
+		x, err := e.extract(check.subject, &enmime.Envelope{Text: check.text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(x.codes, check.codes); diff != nil {
+			t.Errorf("%s: %s", check.name, diff)
+		}
+	}
+
+	custom := &Extract{CodePatterns: []string{`ref ([A-Z]{3}-[0-9]{3})`}}
+	if err := custom.compile(); err != nil {
+		t.Fatal(err)
+	}
+	x, err := custom.extract("", &enmime.Envelope{Text: "your ref ABC-123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(x.codes, []string{"ABC-123"}); diff != nil {
+		t.Errorf("custom pattern: %s", diff)
+	}
+
+	if err := (&Extract{LinkPatterns: []string{"("}}).compile(); err == nil {
+		t.Errorf("expected invalid link pattern to fail validation")
+	}
+}
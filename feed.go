@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	gomail "net/mail"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	defaultFeedPrefix     = "/feeds"
+	defaultFeedMaxEntries = 50
+
+	atomContentType = "application/atom+xml"
+)
+
+// Feed adds the message as an entry to an Atom feed document in the
+// message bucket. BaseURL is the public url the bucket is served
+// from; it is used for the feed's id and for inline images, which
+// are saved under ImagePrefix. Key and ImagePrefix default to keys
+// under the config's feed prefix.
+type Feed struct {
+	Key         string `toml:"key"`
+	Title       string `toml:"title"`
+	BaseURL     string `toml:"base_url"`
+	MaxEntries  int    `toml:"max_entries"`
+	ImagePrefix string `toml:"image_prefix"`
+}
+
+func (f *Feed) validate(name, routeName string) error {
+	if f.Key == "" && routeName == "" {
+		return fmt.Errorf("%s.key must be set when the route has no name", name)
+	}
+	u, err := url.Parse(f.BaseURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%s.base_url must be an http or https url", name)
+	}
+	if f.MaxEntries < 0 {
+		return fmt.Errorf("%s.max_entries must not be negative", name)
+	}
+	return nil
+}
+
+// key returns the bucket key of the feed document for a route.
+func (f *Feed) key(routeName string) string {
+	if f.Key != "" {
+		return path.Join("/", f.Key)
+	}
+	return path.Join(conf.FeedPrefix(), safeFileName(routeName)+".xml")
+}
+
+func (f *Feed) title(routeName string) string {
+	if f.Title != "" {
+		return f.Title
+	}
+	return routeName
+}
+
+func (f *Feed) maxEntries() int {
+	if f.MaxEntries == 0 {
+		return defaultFeedMaxEntries
+	}
+	return f.MaxEntries
+}
+
+func (f *Feed) imagePrefix() string {
+	if f.ImagePrefix == "" {
+		return path.Join(conf.FeedPrefix(), "images")
+	}
+	return f.ImagePrefix
+}
+
+func (c *Config) FeedPrefix() string {
+	if c.Bucket.FeedPrefix == "" {
+		return defaultFeedPrefix
+	}
+	return c.Bucket.FeedPrefix
+}
+
+// url returns the public url of a bucket key.
+func (f *Feed) url(key string) string {
+	return strings.TrimRight(f.BaseURL, "/") + path.Join("/", key)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Content atomContent `xml:"content"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// publishFeed saves the message's inline images and adds it to the
+// route's feed, keeping at most maxEntries entries.
+func publishFeed(lgr log15.Logger, f *Feed, routeName string, record events.SimpleEmailRecord, body *enmime.Envelope) error {
+	var (
+		mail = record.SES.Mail
+		key  = f.key(routeName)
+	)
+
+	content, err := feedContent(f, mail.MessageID, body)
+	if err != nil {
+		return err
+	}
+
+	entry := atomEntry{
+		ID:      fmt.Sprintf("tag:%s,%s:%s", conf.Domain, mail.Timestamp.UTC().Format("2006-01-02"), mail.MessageID),
+		Title:   mail.CommonHeaders.Subject,
+		Updated: mail.Timestamp.UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: strings.Trim(mail.Source, "<>")},
+		Content: content,
+	}
+	if len(mail.CommonHeaders.From) > 0 {
+		if addr, err := gomail.ParseAddress(mail.CommonHeaders.From[0]); err == nil {
+			entry.Author = atomPerson{Name: addr.Name, Email: addr.Address}
+			if addr.Name == "" {
+				entry.Author.Name = addr.Address
+			}
+		}
+	}
+
+	feed, err := getFeed(key)
+	if err != nil {
+		return err
+	}
+
+	entries := []atomEntry{entry}
+	for _, e := range feed.Entries {
+		// a retried invocation replaces its earlier entry
+		if e.ID != entry.ID {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) > f.maxEntries() {
+		entries = entries[:f.maxEntries()]
+	}
+
+	feed.ID = f.url(key)
+	feed.Title = f.title(routeName)
+	feed.Updated = time.Now().UTC().Format(time.RFC3339)
+	feed.Links = []atomLink{{Rel: "self", Href: f.url(key)}}
+	feed.Entries = entries
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal feed %s err: %w", key, err)
+	}
+	out = append([]byte(xml.Header), out...)
+
+	_, err = s3PutObj(&s3manager.UploadInput{
+		Bucket:      &conf.Bucket.Name,
+		Key:         &key,
+		Body:        bytes.NewReader(out),
+		ContentType: aws.String(atomContentType),
+	})
+	if err != nil {
+		return fmt.Errorf("save feed %s err: %w", key, err)
+	}
+
+	lgr.Info("feed_updated", "key", key, "entries", len(entries))
+	return nil
+}
+
+// feedContent returns the entry content for the message. Inline
+// images referenced from the html part are saved to the bucket and
+// their cid: urls rewritten to point at them.
+func feedContent(f *Feed, id string, body *enmime.Envelope) (atomContent, error) {
+	if body.HTML == "" {
+		return atomContent{Type: "html", Body: "<pre>" + html.EscapeString(body.Text) + "</pre>"}, nil
+	}
+
+	content := body.HTML
+	parts := append(append([]*enmime.Part{}, body.Inlines...), body.OtherParts...)
+	for i, part := range parts {
+		if part.ContentID == "" || !strings.HasPrefix(part.ContentType, "image/") {
+			continue
+		}
+		cid := "cid:" + part.ContentID
+		if !strings.Contains(content, cid) {
+			continue
+		}
+
+		key := path.Join("/", f.imagePrefix(), id, fmt.Sprintf("%d-%s", i, safeFileName(part.FileName)))
+		contentType := part.ContentType
+		_, err := s3PutObj(&s3manager.UploadInput{
+			Bucket:      &conf.Bucket.Name,
+			Key:         &key,
+			Body:        bytes.NewReader(part.Content),
+			ContentType: &contentType,
+		})
+		if err != nil {
+			return atomContent{}, fmt.Errorf("save feed image %s err: %w", key, err)
+		}
+
+		content = strings.ReplaceAll(content, cid, f.url(key))
+	}
+
+	return atomContent{Type: "html", Body: content}, nil
+}
+
+// getFeed returns the feed document stored at key, or an empty feed
+// if there is none yet.
+func getFeed(key string) (*atomFeed, error) {
+	obj, err := s3GetObj(&s3.GetObjectInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return &atomFeed{}, nil
+		}
+		return nil, fmt.Errorf("get feed %s err: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	var feed atomFeed
+	if err := xml.NewDecoder(obj.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("parse feed %s err: %w", key, err)
+	}
+	return &feed, nil
+}
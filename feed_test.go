@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestFeed(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Name:      "newsletters",
+				Condition: Condition{Dst: "test@my-ses-email-domain.example.com"},
+				Feed: &Feed{
+					BaseURL:    "https://feeds.example.com/",
+					MaxEntries: 2,
+				},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+
+	log.SetOutput(ioutil.Discard)
+
+	logo := []byte("not really a png")
+	root, err := enmime.Builder().
+		From("Weekly News", "news@example.com").
+		To("", "test@my-ses-email-domain.example.com").
+		Subject("This week").
+		Text([]byte("this week in news")).
+		HTML([]byte(`<p><img src="cid:logo@example.com"> this week in news</p>`)).
+		AddInline(logo, "image/png", "logo.png", "logo@example.com").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := root.Encode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessageBytes(t, id, raw.Bytes())
+
+	sentEmails = nil
+
+	// a retried invocation must not add a second entry
+	for i := 0; i < 2; i++ {
+		if err := Handler(sse); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sentEmails) != 0 {
+		t.Errorf("expected feed message not to be forwarded")
+	}
+
+	feed := readTestFeed(t, "/feeds/newsletters.xml")
+	if feed.Title != "newsletters" || feed.ID != "https://feeds.example.com/feeds/newsletters.xml" {
+		t.Errorf("unexpected feed title=%q id=%q", feed.Title, feed.ID)
+	}
+	if len(feed.Entries) != 1 {
+		t.Fatalf("expected 1 feed entry got %d", len(feed.Entries))
+	}
+
+	entry := feed.Entries[0]
+	if entry.Title != sse.Records[0].SES.Mail.CommonHeaders.Subject {
+		t.Errorf("entry title got %q", entry.Title)
+	}
+	if entry.Content.Type != "html" {
+		t.Errorf("entry content type got %q", entry.Content.Type)
+	}
+
+	imageKey := "/feeds/images/" + id + "/0-logo.png"
+	if got := fakeS3[bucketKey{conf.Bucket.Name, imageKey}]; !bytes.Equal(got, logo) {
+		t.Errorf("inline image got %q expected %q", got, logo)
+	}
+	if !strings.Contains(entry.Content.Body, `src="https://feeds.example.com`+imageKey+`"`) {
+		t.Errorf("inline image not rewritten: %s", entry.Content.Body)
+	}
+
+	// the feed keeps only the newest max_entries entries
+	lgr := log15.New()
+	lgr.SetHandler(log15.DiscardHandler())
+	for _, next := range []string{"second-message", "third-message"} {
+		record := sse.Records[0]
+		record.SES.Mail.MessageID = next
+		if err := publishFeed(lgr, conf.Routes[0].Feed, "newsletters", record, mustEnvelope(t, raw.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feed = readTestFeed(t, "/feeds/newsletters.xml")
+	if len(feed.Entries) != 2 {
+		t.Fatalf("expected 2 feed entries got %d", len(feed.Entries))
+	}
+	if !strings.HasSuffix(feed.Entries[0].ID, ":third-message") || !strings.HasSuffix(feed.Entries[1].ID, ":second-message") {
+		t.Errorf("unexpected feed entries %s, %s", feed.Entries[0].ID, feed.Entries[1].ID)
+	}
+}
+
+func readTestFeed(t *testing.T, key string) atomFeed {
+	t.Helper()
+
+	b, ok := fakeS3[bucketKey{conf.Bucket.Name, key}]
+	if !ok {
+		t.Fatalf("feed not found at %s", key)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(b, &feed); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func mustEnvelope(t *testing.T, raw []byte) *enmime.Envelope {
+	t.Helper()
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
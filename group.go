@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gomail "net/mail"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jhillyerd/enmime"
+)
+
+// Group is an alias that forwards to a list of member addresses,
+// like a small mailing list. Members are listed in config, in a JSON
+// array of addresses stored at MembersKey in the message bucket, or
+// both. Replies from a member to a forwarded group message go back
+// to the original sender from the group alias.
+type Group struct {
+	Alias      string   `toml:"alias"`
+	Name       string   `toml:"name"`
+	Members    []string `toml:"members"`
+	MembersKey string   `toml:"members_key"`
+}
+
+func (g *Group) validate(name string, domains map[string]bool) error {
+	if g.Alias == "" {
+		return fmt.Errorf("%s.alias must be set", name)
+	}
+	if strings.Contains(g.Alias, "@") && !domains[domainOf(g.Alias)] {
+		return fmt.Errorf("%s.alias must be on a configured domain", name)
+	}
+	if len(g.Members) == 0 && g.MembersKey == "" {
+		return fmt.Errorf("%s: members or members_key must be set", name)
+	}
+	for _, m := range g.Members {
+		if err := validGroupMember(m, domains); err != nil {
+			return fmt.Errorf("%s.members: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func validGroupMember(member string, domains map[string]bool) error {
+	addr, err := gomail.ParseAddress(member)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", member)
+	}
+	// a member on one of our domains would loop back through the
+	// lambda
+	if domains[domainOf(addr.Address)] {
+		return fmt.Errorf("member %s must not be on %s", member, domainOf(addr.Address))
+	}
+	return nil
+}
+
+// address returns the group's address on domain.
+func (g *Group) address() string {
+	local := strings.SplitN(g.Alias, "@", 2)[0]
+	return strings.ToLower(local + "@" + conf.Domain)
+}
+
+// listID returns the RFC 2919 List-Id of the group.
+func (g *Group) listID() string {
+	id := "<" + strings.Replace(g.address(), "@", ".", 1) + ">"
+	if g.Name != "" {
+		return fmt.Sprintf("%q %s", g.Name, id)
+	}
+	return id
+}
+
+func (g *Group) addHeaders(b enmime.MailBuilder) enmime.MailBuilder {
+	b = b.Header("List-Id", g.listID())
+	b = b.Header("List-Post", "<mailto:"+g.address()+">")
+	return b
+}
+
+// group returns the group for addr, or nil if addr is not a group
+// alias.
+func (c *Config) group(addr string) *Group {
+	addr = strings.ToLower(addr)
+	for i := range c.Groups {
+		if c.Groups[i].address() == addr {
+			return &c.Groups[i]
+		}
+	}
+	return nil
+}
+
+// configMembers returns the members listed in config.
+func configMembers(g *Group) ([]string, error) {
+	return normalizeMembers(g.Members)
+}
+
+// groupMembers returns the members listed in config and in the
+// members object in the bucket.
+func groupMembers(g *Group) ([]string, error) {
+	members := append([]string{}, g.Members...)
+
+	if g.MembersKey != "" {
+		obj, err := s3GetObj(&s3.GetObjectInput{
+			Bucket: &conf.Bucket.Name,
+			Key:    &g.MembersKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get group members %s err: %w", g.MembersKey, err)
+		}
+		defer obj.Body.Close()
+
+		b, err := ioutil.ReadAll(obj.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read group members %s err: %w", g.MembersKey, err)
+		}
+
+		var stored []string
+		if err := json.Unmarshal(b, &stored); err != nil {
+			return nil, fmt.Errorf("decode group members %s err: %w", g.MembersKey, err)
+		}
+		domains := make(map[string]bool)
+		for _, d := range conf.domainNames {
+			domains[d] = true
+		}
+		for _, m := range stored {
+			if err := validGroupMember(m, domains); err != nil {
+				return nil, fmt.Errorf("group members %s: %w", g.MembersKey, err)
+			}
+		}
+		members = append(members, stored...)
+	}
+
+	return normalizeMembers(members)
+}
+
+// normalizeMembers returns the bare, lower cased addresses of members
+// without duplicates.
+func normalizeMembers(members []string) ([]string, error) {
+	var out []string
+	for _, m := range members {
+		addr, err := gomail.ParseAddress(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group member %q", m)
+		}
+		out = appendUnique(out, strings.ToLower(addr.Address))
+	}
+	return out, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-test/deep"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestGroup(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Groups: []Group{
+			{
+				Alias:      "test",
+				Name:       "Test Family",
+				Members:    []string{"Alice <alice@example.net>", "bob@example.org"},
+				MembersKey: "/groups/test.json",
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	fakeS3[bucketKey{conf.Bucket.Name, "/groups/test.json"}] = []byte(`["carol@example.com", "bob@example.org"]`)
+
+	sse := loadTestEvent(t)
+	id := sse.Records[0].SES.Mail.MessageID
+	putTestMessage(t, id, "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 group email got %d", len(sentEmails))
+	}
+	sent := sentEmails[0]
+	expectMembers := []string{"alice@example.net", "bob@example.org", "carol@example.com"}
+	if diff := deep.Equal(aws.StringValueSlice(sent.input.Destinations), expectMembers); diff != nil {
+		t.Errorf("group destinations: %s", diff)
+	}
+	if got := *sent.input.Source; got != "test@my-ses-email-domain.example.com" {
+		t.Errorf("group source got %s", got)
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(sent.input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		header string
+		expect string
+	}{
+		{"To", "<test@my-ses-email-domain.example.com>"},
+		{"List-Id", `"Test Family" <test.my-ses-email-domain.example.com>`},
+		{"List-Post", "<mailto:test@my-ses-email-domain.example.com>"},
+	}
+	for _, c := range checks {
+		if got := env.GetHeader(c.header); got != c.expect {
+			t.Errorf("%s: got %q expected %q", c.header, got, c.expect)
+		}
+	}
+
+	// a member's reply goes back to the original sender from the
+	// group alias
+	root, err := enmime.Builder().
+		From("Carol", "carol@example.com").
+		To("", "test@my-ses-email-domain.example.com").
+		Subject("Re: save off header").
+		Header("In-Reply-To", "<"+sent.sendID+"@email.amazonses.com>").
+		Text([]byte("sounds good")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := root.Encode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := loadTestEvent(t)
+	reply.Records[0].SES.Mail.MessageID = "member-reply"
+	reply.Records[0].SES.Mail.Source = "carol@example.com"
+	reply.Records[0].SES.Mail.CommonHeaders.From = []string{"Carol <carol@example.com>"}
+	putTestMessageBytes(t, "member-reply", raw.Bytes())
+
+	sentEmails = nil
+
+	if err := Handler(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 reply email got %d", len(sentEmails))
+	}
+	sent = sentEmails[0]
+	if diff := deep.Equal(aws.StringValueSlice(sent.input.Destinations), []string{"psanford@example.com"}); diff != nil {
+		t.Errorf("reply destinations: %s", diff)
+	}
+	if got := *sent.input.Source; got != "test@my-ses-email-domain.example.com" {
+		t.Errorf("reply source got %s", got)
+	}
+
+	// a new message from a member goes to the other members
+	post := loadTestEvent(t)
+	post.Records[0].SES.Mail.MessageID = "member-post"
+	post.Records[0].SES.Mail.CommonHeaders.From = []string{"bob@example.org"}
+	putTestMessage(t, "member-post", "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(post); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 group email got %d", len(sentEmails))
+	}
+	if diff := deep.Equal(aws.StringValueSlice(sentEmails[0].input.Destinations), []string{"alice@example.net", "carol@example.com"}); diff != nil {
+		t.Errorf("member post destinations: %s", diff)
+	}
+}
+
+func TestGroupValidate(t *testing.T) {
+	checks := []struct {
+		name  string
+		g     Group
+		valid bool
+	}{
+		{"ok", Group{Alias: "family", Members: []string{"a@example.com"}}, true},
+		{"full_alias", Group{Alias: "family@my-ses-email-domain.example.com", MembersKey: "/groups/family.json"}, true},
+		{"no_alias", Group{Members: []string{"a@example.com"}}, false},
+		{"other_domain", Group{Alias: "family@example.com", Members: []string{"a@example.com"}}, false},
+		{"no_members", Group{Alias: "family"}, false},
+		{"bad_member", Group{Alias: "family", Members: []string{"not an address"}}, false},
+		{"loop", Group{Alias: "family", Members: []string{"other@my-ses-email-domain.example.com"}}, false},
+		{"proxy_domain_alias", Group{Alias: "family@other.example.org", Members: []string{"a@example.com"}}, true},
+		{"proxy_domain_loop", Group{Alias: "family", Members: []string{"other@other.example.org"}}, false},
+	}
+
+	domains := map[string]bool{"my-ses-email-domain.example.com": true, "other.example.org": true}
+	for _, check := range checks {
+		err := check.g.validate("group", domains)
+		if (err == nil) != check.valid {
+			t.Errorf("%s: valid=%t got err=%v", check.name, check.valid, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/psanford/lambda-email/registry"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func listAliases(c *cli.Context) error {
+	bucket := c.String("bucket")
+	aliasPrefix := c.String("alias_prefix")
+
+	if bucket == "" {
+		return fmt.Errorf("-bucket is requred")
+	}
+
+	if aliasPrefix == "" {
+		return fmt.Errorf("-alias_prefix is requred")
+	}
+
+	var obj s3.Object
+	iter := listObjects(bucket, aliasPrefix+"/", &obj)
+
+	for iter.Next() {
+		a, err := getAlias(bucket, *obj.Key)
+		if err != nil {
+			return err
+		}
+
+		lastUsed := "never"
+		if a.LastUsedAt != nil {
+			lastUsed = a.LastUsedAt.Format(time.RFC3339)
+		}
+
+		fmt.Printf("%s %s created=%s last_used=%s first_sender=%q note=%q\n", a.Alias, a.Status, a.CreatedAt.Format(time.RFC3339), lastUsed, a.FirstSender, a.Note)
+	}
+
+	return iter.Close()
+}
+
+// addAlias registers an alias, or updates the note of an existing one.
+func addAlias(c *cli.Context) error {
+	return updateAlias(c, func(a *registry.Alias) {
+		if note := c.String("note"); note != "" {
+			a.Note = note
+		}
+	})
+}
+
+func disableAlias(c *cli.Context) error {
+	return updateAlias(c, func(a *registry.Alias) {
+		a.Status = registry.StatusDisabled
+	})
+}
+
+func enableAlias(c *cli.Context) error {
+	return updateAlias(c, func(a *registry.Alias) {
+		a.Status = registry.StatusActive
+	})
+}
+
+// updateAlias applies update to the registry entry for the alias
+// argument, creating the entry if it doesn't exist.
+func updateAlias(c *cli.Context, update func(a *registry.Alias)) error {
+	bucket := c.String("bucket")
+	aliasPrefix := c.String("alias_prefix")
+
+	if bucket == "" {
+		return fmt.Errorf("-bucket is requred")
+	}
+
+	if aliasPrefix == "" {
+		return fmt.Errorf("-alias_prefix is requred")
+	}
+
+	addr := strings.ToLower(c.Args().First())
+	if !strings.Contains(addr, "@") {
+		return fmt.Errorf("must specify alias address")
+	}
+
+	key := path.Join(aliasPrefix, addr)
+	a, err := getAlias(bucket, key)
+	if err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != s3.ErrCodeNoSuchKey {
+			return err
+		}
+		a = registry.Alias{
+			Alias:     addr,
+			Status:    registry.StatusActive,
+			CreatedAt: time.Now(),
+		}
+	}
+
+	update(&a)
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3Uploader.Upload(&s3manager.UploadInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update alias: %s", err)
+	}
+	log.Printf("Updated %s (%s)", addr, a.Status)
+
+	return nil
+}
+
+func getAlias(bucket, key string) (registry.Alias, error) {
+	var a registry.Alias
+
+	obj, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return a, fmt.Errorf("get %s err: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	err = json.NewDecoder(obj.Body).Decode(&a)
+	return a, err
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/ses"
@@ -25,6 +26,8 @@ var (
 	sesClient  *ses.SES
 	s3Uploader *s3manager.Uploader
 
+	lambdaClient *lambda.Lambda
+
 	region        string
 	defaultRegion = "us-east-1"
 )
@@ -128,6 +131,106 @@ func main() {
 		},
 	}
 
+	quarantineFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "bucket",
+			Value: "",
+			Usage: "S3 message bucket",
+		},
+		cli.StringFlag{
+			Name:  "msg_prefix",
+			Value: "/email",
+			Usage: "S3 bucket message prefix",
+		},
+		cli.StringFlag{
+			Name:  "quarantine_prefix",
+			Value: "/quarantine",
+			Usage: "S3 bucket quarantine prefix",
+		},
+	}
+
+	app.Commands = append(app.Commands, cli.Command{
+		Name:  "quarantine",
+		Usage: "Manage quarantined messages",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List quarantined messages",
+				Action: listQuarantine,
+				Flags:  quarantineFlags,
+			},
+			{
+				Name:      "release",
+				Usage:     "Release a quarantined message and run it through normal forwarding",
+				ArgsUsage: "<id>",
+				Action:    releaseQuarantine,
+				Flags: append(quarantineFlags, cli.StringFlag{
+					Name:  "function",
+					Value: "",
+					Usage: "Name of the lambda-email function",
+				}),
+			},
+			{
+				Name:      "purge",
+				Usage:     "Delete a quarantined message",
+				ArgsUsage: "<id>",
+				Action:    purgeQuarantine,
+				Flags:     quarantineFlags,
+			},
+		},
+	})
+
+	aliasFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "bucket",
+			Value: "",
+			Usage: "S3 message bucket",
+		},
+		cli.StringFlag{
+			Name:  "alias_prefix",
+			Value: "/aliases",
+			Usage: "S3 bucket alias registry prefix",
+		},
+	}
+
+	app.Commands = append(app.Commands, cli.Command{
+		Name:  "alias",
+		Usage: "Manage the alias registry",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List registered aliases",
+				Action: listAliases,
+				Flags:  aliasFlags,
+			},
+			{
+				Name:      "add",
+				Usage:     "Register an alias or update its note",
+				ArgsUsage: "<alias>",
+				Action:    addAlias,
+				Flags: append(aliasFlags, cli.StringFlag{
+					Name:  "note",
+					Value: "",
+					Usage: "Where the alias was given out (e.g. 'signed up at example.com')",
+				}),
+			},
+			{
+				Name:      "disable",
+				Usage:     "Drop all mail to an alias",
+				ArgsUsage: "<alias>",
+				Action:    disableAlias,
+				Flags:     aliasFlags,
+			},
+			{
+				Name:      "enable",
+				Usage:     "Accept mail to a disabled alias again",
+				ArgsUsage: "<alias>",
+				Action:    enableAlias,
+				Flags:     aliasFlags,
+			},
+		},
+	})
+
 	sort.Sort(cli.CommandsByName(app.Commands))
 
 	awsSession := session.New(&aws.Config{
@@ -136,6 +239,7 @@ func main() {
 	s3Client = s3.New(awsSession)
 	s3Uploader = s3manager.NewUploader(awsSession)
 	sesClient = ses.New(awsSession)
+	lambdaClient = lambda.New(awsSession)
 
 	err := app.Run(os.Args)
 	if err != nil {
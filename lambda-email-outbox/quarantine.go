@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/psanford/lambda-email/quarantine"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func listQuarantine(c *cli.Context) error {
+	bucket := c.String("bucket")
+	quarantinePrefix := c.String("quarantine_prefix")
+
+	if bucket == "" {
+		return fmt.Errorf("-bucket is requred")
+	}
+
+	if quarantinePrefix == "" {
+		return fmt.Errorf("-quarantine_prefix is requred")
+	}
+
+	var obj s3.Object
+	iter := listObjects(bucket, quarantinePrefix+"/", &obj)
+
+	for iter.Next() {
+		if !strings.HasSuffix(*obj.Key, ".json") {
+			continue
+		}
+
+		info, err := getQuarantineInfo(bucket, *obj.Key)
+		if err != nil {
+			return err
+		}
+
+		var from string
+		if len(info.From) > 0 {
+			from = info.From[0]
+		}
+
+		fmt.Printf("%s %s %s %s from=%q subject=%q\n", info.ID, info.QuarantinedAt.Format(time.RFC3339), info.Status, strings.Join(info.Reasons, ","), from, info.Subject)
+	}
+
+	return iter.Close()
+}
+
+func releaseQuarantine(c *cli.Context) error {
+	bucket := c.String("bucket")
+	quarantinePrefix := c.String("quarantine_prefix")
+	function := c.String("function")
+
+	if bucket == "" {
+		return fmt.Errorf("-bucket is requred")
+	}
+
+	if quarantinePrefix == "" {
+		return fmt.Errorf("-quarantine_prefix is requred")
+	}
+
+	if function == "" {
+		return fmt.Errorf("-function is requred")
+	}
+
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("must specify message id")
+	}
+
+	infoKey := path.Join(quarantinePrefix, id+".json")
+	info, err := getQuarantineInfo(bucket, infoKey)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	info.Status = quarantine.StatusReleased
+	info.ReleasedAt = &now
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3Uploader.Upload(&s3manager.UploadInput{
+		Bucket: &bucket,
+		Key:    &infoKey,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update quarantine info: %s", err)
+	}
+	log.Printf("Marked %s released", id)
+
+	payload, err := json.Marshal(events.SimpleEmailEvent{
+		Records: []events.SimpleEmailRecord{info.Record},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = lambdaClient.Invoke(&lambda.InvokeInput{
+		FunctionName:   &function,
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to invoke %s: %s", function, err)
+	}
+	log.Printf("Invoked %s for %s", function, id)
+
+	return nil
+}
+
+func purgeQuarantine(c *cli.Context) error {
+	bucket := c.String("bucket")
+	msgPrefix := c.String("msg_prefix")
+	quarantinePrefix := c.String("quarantine_prefix")
+
+	if bucket == "" {
+		return fmt.Errorf("-bucket is requred")
+	}
+
+	if msgPrefix == "" {
+		return fmt.Errorf("-msg_prefix is requred")
+	}
+
+	if quarantinePrefix == "" {
+		return fmt.Errorf("-quarantine_prefix is requred")
+	}
+
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("must specify message id")
+	}
+
+	keys := []string{
+		path.Join(msgPrefix, id),
+		path.Join(quarantinePrefix, id),
+		path.Join(quarantinePrefix, id+".json"),
+	}
+
+	for _, key := range keys {
+		key := key
+		_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to delete %s: %s", key, err)
+		}
+		log.Printf("Deleted %s", key)
+	}
+
+	return nil
+}
+
+func getQuarantineInfo(bucket, key string) (quarantine.Info, error) {
+	var info quarantine.Info
+
+	obj, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return info, fmt.Errorf("get %s err: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	err = json.NewDecoder(obj.Body).Decode(&info)
+	return info, err
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	gomail "net/mail"
@@ -16,12 +17,15 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	awslambda "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/inconshreveable/log15"
 	"github.com/jhillyerd/enmime"
 	"github.com/psanford/lambda-email/snsmsg"
@@ -38,156 +42,237 @@ var (
 	awsMailerDaemon = "mailer-daemon@amazonses.com"
 )
 
+// conf is the config for the domain being handled. Handler and
+// ScheduledHandler point it at each proxy domain's and tenant's
+// config in turn.
 var conf *Config
 
-func Handler(sse events.SimpleEmailEvent) error {
+// handleEvent is the lambda entrypoint. CloudWatch scheduled events
+// send pending digests; everything else is an SES receipt event.
+func handleEvent(raw json.RawMessage) error {
+	var probe struct {
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return fmt.Errorf("decode event err: %w", err)
+	}
+
+	if probe.DetailType == "Scheduled Event" {
+		var ev events.CloudWatchEvent
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			return fmt.Errorf("decode scheduled event err: %w", err)
+		}
+		return ScheduledHandler(ev)
+	}
+
+	var sse events.SimpleEmailEvent
+	if err := json.Unmarshal(raw, &sse); err != nil {
+		return fmt.Errorf("decode ses event err: %w", err)
+	}
+	return Handler(sse)
+}
+
+// setup configures logging and, on the first invocation, loads the
+// config and creates the aws clients.
+func setup() error {
 	handler := log15.StreamHandler(os.Stdout, log15.LogfmtFormat())
 	log15.Root().SetHandler(handler)
 
 	if conf == nil {
 		conf = loadConfig()
 		initAWS()
+		if err := conf.loadSieve(); err != nil {
+			conf = nil
+			return err
+		}
+		if err := conf.loadTenants(); err != nil {
+			conf = nil
+			return err
+		}
 	}
+	return nil
+}
 
-	var errors []error
-	for _, record := range sse.Records {
-		var (
-			mail         = record.SES.Mail
-			receipt      = record.SES.Receipt
-			subject      = mail.CommonHeaders.Subject
-			toHeader     = mail.CommonHeaders.To
-			originalFrom = mail.CommonHeaders.From
-
-			fromAddr   string
-			toOutbound bool
-		)
+func Handler(sse events.SimpleEmailEvent) error {
+	if err := setup(); err != nil {
+		return err
+	}
 
-		lgr := log15.New("msg_id", mail.MessageID, "from", originalFrom, "to", toHeader, "subject", subject, "spam", receipt.SpamVerdict.Status, "dkim", receipt.DKIMVerdict.Status, "spf", receipt.SPFVerdict.Status, "virus", receipt.VirusVerdict.Status)
+	dryRun := os.Getenv("DRY_RUN") != ""
 
-		type suspectReason struct {
-			name   string
-			status string
-		}
+	root := conf
+	defer func() {
+		conf = root
+	}()
+
+	var errors []error
+	for _, record := range sse.Records {
+		conf = root.forRecord(record)
 
 		var (
-			virus   bool
-			suspect []suspectReason
+			mail    = record.SES.Mail
+			receipt = record.SES.Receipt
 		)
 
-		if receipt.DKIMVerdict.Status != "PASS" {
-			suspect = append(suspect, suspectReason{
-				name:   "dkim_verdict",
-				status: receipt.DKIMVerdict.Status,
-			})
+		lgr := log15.New("msg_id", mail.MessageID, "domain", conf.Domain, "from", mail.CommonHeaders.From, "to", mail.CommonHeaders.To, "subject", mail.CommonHeaders.Subject, "spam", receipt.SpamVerdict.Status, "dkim", receipt.DKIMVerdict.Status, "spf", receipt.SPFVerdict.Status, "virus", receipt.VirusVerdict.Status, "dmarc", receipt.DMARCVerdict.Status)
+
+		ok, err := useQuota(mail, !dryRun)
+		if err != nil {
+			lgr.Error("quota_err", "err", err)
+			errors = append(errors, err)
+			continue
 		}
-		if receipt.SPFVerdict.Status != "PASS" {
-			suspect = append(suspect, suspectReason{
-				name:   "spf_verdict",
-				status: receipt.DKIMVerdict.Status,
-			})
+		if !ok {
+			lgr.Warn("quota_exceeded", "daily_messages", conf.Quota.DailyMessages)
+			continue
 		}
-		if receipt.VirusVerdict.Status != "PASS" {
-			suspect = append(suspect, suspectReason{
-				name:   "virus_verdict",
-				status: receipt.DKIMVerdict.Status,
-			})
-			virus = true
+
+		if err := handleRecord(lgr, record, dryRun); err != nil {
+			errors = append(errors, err)
 		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%+v", errors)
+	}
 
-		lgr.Info("got_message", "suspect", suspect)
+	return nil
+}
 
-		if virus {
-			lgr.Info("virus_email_not_processing")
-			err := sendErrorEmail("Virus email, not processing", record)
-			if err != nil {
-				lgr.Error("sendError err", "err", err)
-			}
-			return nil
-		}
+// handleRecord plans and, unless dryRun is set, executes the actions
+// for a record that is within the quota.
+func handleRecord(lgr log15.Logger, record events.SimpleEmailRecord, dryRun bool) error {
+	plan, err := s3Planner(lgr).plan(record)
+	if err != nil {
+		lgr.Error("plan_err", "err", err)
+		return err
+	}
 
-		if len(originalFrom) > 0 {
-			if addr, err := gomail.ParseAddress(originalFrom[0]); err == nil {
-				fromAddr = addr.Address
-			}
-		}
+	plan.log(lgr)
+	if dryRun {
+		lgr.Info("dry_run_not_executing")
+		return nil
+	}
 
-		if strings.ToLower(fromAddr) == awsMailerDaemon {
-			lgr.Info("mailer_daemon_notification_not_forwading")
-			err := sendErrorEmail("aws mailer-daemon notification, not forwarding", record)
-			if err != nil {
-				lgr.Error("sendError err", "err", err)
-			}
-			return nil
+	return plan.execute(lgr)
+}
+
+// routeResult is the outcome of evaluating the routes against a
+// message.
+type routeResult struct {
+	// matched are the routes whose actions should run, in order
+	matched []Route
+	// dropped is set when a drop route matched
+	dropped bool
+	// bounces are the matching bounce routes and the recipients
+	// each one bounces
+	bounces []routeBounce
+	// recipients are the message's recipients that haven't been
+	// bounced
+	recipients []string
+	// policy is set when a matching route's policy stops the
+	// message from being processed normally
+	policy *policyDecision
+	// decision is the most severe decision of the matched routes
+	// whose policy let the message through, such as tag
+	decision       *policyDecision
+	skipForwarding bool
+}
+
+type routeBounce struct {
+	bounce     *Bounce
+	recipients []string
+}
+
+// evalRoutes evaluates the routes against msg in priority order
+// without running any of their actions. released reports whether
+// the message was quarantined and has since been released; it is
+// only called when a route policy would quarantine the message.
+func evalRoutes(lgr log15.Logger, msg routeMsg, record events.SimpleEmailRecord, released func() bool) (routeResult, error) {
+	result := routeResult{
+		recipients: record.SES.Receipt.Recipients,
+	}
+
+	for _, rule := range conf.routes {
+		match, err := rule.Match(msg)
+		if err != nil {
+			lgr.Error("match_rule_err", "err", err)
+			continue
+		}
+		if !match {
+			continue
 		}
 
-		for _, toAddr := range toHeader {
-			if addr, err := gomail.ParseAddress(toAddr); err == nil {
-				if addr.Address == conf.OutboundAddress {
-					toOutbound = true
-				}
-			}
+		if rule.Drop {
+			lgr.Info("matched_drop_rule")
+			result.dropped = true
+			return result, nil
 		}
 
-		var skipForwarding bool
+		decision := decidePolicy(record.SES.Receipt, rule.policyAction)
 
-		for _, rule := range conf.Routes {
-			match, err := rule.Match(toHeader, fromAddr)
+		if rule.Bounce != nil {
+			// bouncing mail with a forged sender sends backscatter to
+			// whoever was forged, so suspect messages are dropped instead
+			if failed := decision.failed(); len(failed) > 0 {
+				lgr.Info("matched_bounce_rule_suspect_dropping", "suspect", failed)
+				result.dropped = true
+				return result, nil
+			}
+			bounced, err := bounceRecipients(rule, msg, result.recipients)
 			if err != nil {
 				lgr.Error("match_rule_err", "err", err)
 				continue
 			}
-			if match {
-				if rule.Drop {
-					lgr.Info("matched_drop_rule")
-					return nil
-				}
-
-				if len(suspect) > 0 && !rule.AllowSuspectMessages {
-					lgr.Error("matched_rule_but_suspect", "rule", rule, "suspect", subject)
-					return fmt.Errorf("matched_rule_but_suspect %s", mail.MessageID)
-				}
-
-				lgr.Info("publish_sns_route", "sns_topic", rule.SNS)
-				err = publishSNS(rule.SNS, record)
-				if err != nil {
-					lgr.Error("publish_sns_err", "err", err)
-					return err
-				}
-				if !rule.Forward {
-					skipForwarding = true
-				}
+			if len(bounced) == 0 {
+				lgr.Info("matched_bounce_rule_no_recipients")
+				continue
+			}
+			lgr.Info("matched_bounce_rule", "recipients", bounced)
+			result.bounces = append(result.bounces, routeBounce{bounce: rule.Bounce, recipients: bounced})
+			result.recipients = removeAddrs(result.recipients, bounced)
+			if len(result.recipients) == 0 {
+				return result, nil
 			}
+			// later routes only see the recipients that weren't bounced
+			msg = msg.without(bounced)
+			continue
 		}
 
-		if !skipForwarding {
-			if fromAddr == conf.PrivateAccountAddress {
-				if toOutbound {
-					if err := handleOutbound(record); err != nil {
-						lgr.Error("handle_outbound_err", "err", err)
-						errors = append(errors, err)
-					}
-				} else {
-					if err := handleReply(lgr, record); err != nil {
-						lgr.Error("handle_reply_err", "err", err)
-						errors = append(errors, err)
-					}
-				}
-			} else {
-				if err := forwardToGmail(record); err != nil {
-					lgr.Error("forward_to_gmail_err", "err", err)
-					errors = append(errors, err)
-				}
+		switch decision.action {
+		case policyFail:
+			lgr.Error("matched_rule_but_suspect", "rule", rule, "suspect", decision.failed())
+			return result, fmt.Errorf("matched_rule_but_suspect %s", record.SES.Mail.MessageID)
+		case policyDrop:
+			lgr.Info("matched_rule_policy_drop", "rule", rule, "suspect", decision.failed())
+			result.dropped = true
+			return result, nil
+		case policyQuarantine:
+			if !released() {
+				result.policy = &decision
+				return result, nil
 			}
-		} else {
-			lgr.Info("skip_forwarding")
+			decision.action = policyForward
+		case policyNotify:
+			result.policy = &decision
+			return result, nil
 		}
-	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("%+v", errors)
+		if result.decision != nil {
+			decision = result.decision.merge(decision)
+		}
+		result.decision = &decision
+
+		result.matched = append(result.matched, rule)
+		if !rule.Forward {
+			result.skipForwarding = true
+		}
+		if rule.Stop {
+			break
+		}
 	}
 
-	return nil
+	return result, nil
 }
 
 func handleOutbound(record events.SimpleEmailRecord) error {
@@ -203,10 +288,14 @@ func handleOutbound(record events.SimpleEmailRecord) error {
 }
 
 func sendErrorEmail(msg string, record events.SimpleEmailRecord) error {
+	return sendNotice(conf.PrivateAccountMailbox()+"@"+conf.PrivateAccountDomain(), msg, record)
+}
+
+// sendNotice sends msg and the record to forwardToAddr.
+func sendNotice(forwardToAddr, msg string, record events.SimpleEmailRecord) error {
 	b := enmime.Builder()
 	fromAddr := "error@" + conf.Domain
 	b = b.From("Lambda Email Error", fromAddr)
-	forwardToAddr := conf.PrivateAccountMailbox() + "@" + conf.PrivateAccountDomain()
 	b = b.To("", forwardToAddr)
 	b = b.Subject("Lambda Email Error")
 
@@ -241,18 +330,19 @@ func sendErrorEmail(msg string, record events.SimpleEmailRecord) error {
 	return nil
 }
 
-func forwardToGmail(record events.SimpleEmailRecord) error {
-	var (
-		forwardToAddr      string
-		substituteFromAddr string
-		substituteFromName string
-
-		mail         = record.SES.Mail
-		subject      = mail.CommonHeaders.Subject
-		toHeader     = mail.CommonHeaders.To
-		originalFrom = mail.CommonHeaders.From
-	)
+// proxyRecipient returns the first recipient of the message on the
+// domain being handled.
+func proxyRecipient(record events.SimpleEmailRecord) string {
+	if recipients := proxyRecipients(record); len(recipients) > 0 {
+		return recipients[0]
+	}
+	return ""
+}
 
+// proxyRecipients returns every recipient of the message on the
+// domain, lower cased.
+func proxyRecipients(record events.SimpleEmailRecord) []string {
+	var out []string
 	for _, recipient := range record.SES.Receipt.Recipients {
 		recipient = strings.ToLower(recipient)
 		parts := strings.SplitN(recipient, "@", 2)
@@ -261,14 +351,41 @@ func forwardToGmail(record events.SimpleEmailRecord) error {
 		}
 
 		if parts[1] == conf.Domain {
-			sanitized := replaceRegex.ReplaceAllString(parts[0], "_")
-			forwardToAddr = conf.PrivateAccountMailbox() + "+" + sanitized + "@" + conf.PrivateAccountDomain()
-			substituteFromAddr = recipient
-			break
+			out = append(out, recipient)
 		}
 	}
+	return out
+}
+
+// forwardOptions adjusts a forwarded message.
+type forwardOptions struct {
+	// subjectCode is prepended to the subject
+	subjectCode string
+	// vip marks the message as high priority
+	vip bool
+	// group sends the message to the group's members as a list
+	// message
+	group   *Group
+	members []string
+	// unknownAlias warns that the alias is not in the registry
+	unknownAlias bool
+}
+
+// forwardMessage sends a copy of the message to forwardToAddr from
+// the proxy address it was sent to. Group messages are addressed to
+// forwardToAddr and sent to the group members.
+func forwardMessage(record events.SimpleEmailRecord, body *enmime.Envelope, policy policyDecision, forwardToAddr string, opts forwardOptions) error {
+	var (
+		substituteFromAddr = proxyRecipient(record)
+		substituteFromName string
 
-	if forwardToAddr == "" {
+		mail         = record.SES.Mail
+		subject      = mail.CommonHeaders.Subject
+		toHeader     = mail.CommonHeaders.To
+		originalFrom = mail.CommonHeaders.From
+	)
+
+	if substituteFromAddr == "" {
 		return fmt.Errorf("Failed to find %s address for email %s", conf.Domain, mail.MessageID)
 	}
 
@@ -278,20 +395,16 @@ func forwardToGmail(record events.SimpleEmailRecord) error {
 		}
 	}
 
-	msgReader, err := getMessage(mail.MessageID)
-	if err != nil {
-		return fmt.Errorf("GetMessage err=%q", err)
-	}
-
-	body, err := enmime.ReadEnvelope(msgReader)
-	if err != nil {
-		return fmt.Errorf("Parse email err=%q", err)
-	}
-
 	b := enmime.Builder()
 	b = b.From(substituteFromName, substituteFromAddr)
 	b = b.To("", forwardToAddr)
-	b = b.Subject(subject)
+	if opts.subjectCode != "" {
+		subject = opts.subjectCode + " - " + subject
+	}
+	if opts.unknownAlias {
+		subject = "[unknown alias] " + subject
+	}
+	b = b.Subject(policy.subject(subject))
 	if len(body.Text) > 0 {
 		b = b.Text([]byte(body.Text))
 	}
@@ -326,6 +439,17 @@ func forwardToGmail(record events.SimpleEmailRecord) error {
 	b = b.Header("X-Lambdaemail-Id", mail.MessageID)
 	b = b.Header("X-Lambdaemail-Has-Attachments", strconv.FormatBool(hasAttachments))
 	b = b.Header("X-Lambdaemail-Has-Other-Attachments", strconv.FormatBool(hasOtherAttachments))
+	b = policy.addHeaders(b)
+	if opts.vip {
+		b = b.Header("X-Lambdaemail-Priority", "vip")
+		b = b.Header("Importance", "high")
+	}
+	if opts.group != nil {
+		b = opts.group.addHeaders(b)
+	}
+	if opts.unknownAlias {
+		b = b.Header("X-Lambdaemail-Alias", "unknown")
+	}
 
 	root, err := b.Build()
 	if err != nil {
@@ -337,8 +461,13 @@ func forwardToGmail(record events.SimpleEmailRecord) error {
 		return fmt.Errorf("Encode forward email err=%q", err)
 	}
 
+	destinations := []string{forwardToAddr}
+	if opts.group != nil {
+		destinations = opts.members
+	}
+
 	sendEmailInput := &ses.SendRawEmailInput{
-		Destinations: strList([]string{forwardToAddr}),
+		Destinations: strList(destinations),
 		RawMessage: &ses.RawMessage{
 			Data: buf.Bytes(),
 		},
@@ -370,7 +499,7 @@ func forwardToGmail(record events.SimpleEmailRecord) error {
 	return nil
 }
 
-func handleReply(lgr log15.Logger, record events.SimpleEmailRecord) error {
+func handleReply(lgr log15.Logger, record events.SimpleEmailRecord, body *enmime.Envelope) error {
 	// lookup what we are replying to
 	// fetch original message
 	// get from address from that message
@@ -388,19 +517,7 @@ func handleReply(lgr log15.Logger, record events.SimpleEmailRecord) error {
 		substituteFromName string
 	)
 
-	for _, recipient := range record.SES.Receipt.Recipients {
-		recipient = strings.ToLower(recipient)
-		parts := strings.SplitN(recipient, "@", 2)
-		if len(parts) < 2 {
-			continue
-		}
-
-		if parts[1] == conf.Domain {
-			proxyAddr = recipient
-			break
-		}
-	}
-
+	proxyAddr = proxyRecipient(record)
 	if proxyAddr == "" {
 		return fmt.Errorf("Failed to find %s address for email %s", conf.Domain, mail.MessageID)
 	}
@@ -411,16 +528,6 @@ func handleReply(lgr log15.Logger, record events.SimpleEmailRecord) error {
 		}
 	}
 
-	msgReader, err := getMessage(mail.MessageID)
-	if err != nil {
-		return fmt.Errorf("GetMessage err=%q", err)
-	}
-
-	body, err := enmime.ReadEnvelope(msgReader)
-	if err != nil {
-		return fmt.Errorf("Parse email err=%q", err)
-	}
-
 	inReplyTo := trimBrackets(body.GetHeader("In-Reply-To"))
 	if inReplyTo == "" {
 		return fmt.Errorf("No in-reply-to header found")
@@ -506,11 +613,11 @@ func handleReply(lgr log15.Logger, record events.SimpleEmailRecord) error {
 	return nil
 }
 
-func publishSNS(topic string, record events.SimpleEmailRecord) error {
+func newMsg(record events.SimpleEmailRecord) (snsmsg.Msg, error) {
 	id := record.SES.Mail.MessageID
-	url, err := presignMessage(id)
+	url, err := presignKey(path.Join(conf.Bucket.MsgPrefix, id))
 	if err != nil {
-		return fmt.Errorf("presign url for %s err: %w", id, err)
+		return snsmsg.Msg{}, fmt.Errorf("presign url for %s err: %w", id, err)
 	}
 
 	msg := snsmsg.Msg{
@@ -522,12 +629,26 @@ func publishSNS(topic string, record events.SimpleEmailRecord) error {
 		PresignedURL: url,
 	}
 
+	return msg, nil
+}
+
+// msgPayload builds the snsmsg.Msg JSON payload delivered to route
+// integrations.
+func msgPayload(msg snsmsg.Msg) (string, error) {
 	payloadBytes, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("marshal sqs msg err: %w", err)
+		return "", fmt.Errorf("marshal sqs msg err: %w", err)
 	}
 
-	payload := string(payloadBytes)
+	return string(payloadBytes), nil
+}
+
+func publishSNS(topic string, msg snsmsg.Msg) error {
+	id := msg.ID
+	payload, err := msgPayload(msg)
+	if err != nil {
+		return err
+	}
 
 	_, err = snsPublish(&sns.PublishInput{
 		Message:  &payload,
@@ -541,14 +662,58 @@ func publishSNS(topic string, record events.SimpleEmailRecord) error {
 	return nil
 }
 
+func sendSQS(queueURL string, msg snsmsg.Msg) error {
+	id := msg.ID
+	payload, err := msgPayload(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = sqsSend(&sqs.SendMessageInput{
+		MessageBody: &payload,
+		QueueUrl:    &queueURL,
+	})
+
+	if err != nil {
+		return fmt.Errorf("sqsSend err for %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func invokeLambda(function string, msg snsmsg.Msg) error {
+	id := msg.ID
+	payload, err := msgPayload(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = lambdaInvoke(&awslambda.InvokeInput{
+		FunctionName:   &function,
+		InvocationType: aws.String(awslambda.InvocationTypeEvent),
+		Payload:        []byte(payload),
+	})
+
+	if err != nil {
+		return fmt.Errorf("lambdaInvoke err for %s: %w", id, err)
+	}
+
+	return nil
+}
+
 var (
 	sendEmail   func(*ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error)
+	sendBounce  func(*ses.SendBounceInput) (*ses.SendBounceOutput, error)
 	s3GetObj    func(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
 	s3PutObj    func(*s3manager.UploadInput, ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
 	s3CopyObj   func(*s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	s3DeleteObj func(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
 	s3GetObjReq func(*s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput)
+	s3ListObjs  func(*s3.ListObjectsInput) (*s3.ListObjectsOutput, error)
 
-	snsPublish func(*sns.PublishInput) (*sns.PublishOutput, error)
+	snsPublish   func(*sns.PublishInput) (*sns.PublishOutput, error)
+	sqsSend      func(*sqs.SendMessageInput) (*sqs.SendMessageOutput, error)
+	lambdaInvoke func(*awslambda.InvokeInput) (*awslambda.InvokeOutput, error)
 )
 
 func trimBrackets(s string) string {
@@ -563,13 +728,20 @@ func initAWS() {
 	s3Uploader := s3manager.NewUploader(awsSession)
 	sesClient := ses.New(awsSession)
 	snsClient := sns.New(awsSession)
+	sqsClient := sqs.New(awsSession)
+	lambdaClient := awslambda.New(awsSession)
 
 	sendEmail = sesClient.SendRawEmail
+	sendBounce = sesClient.SendBounce
 	s3GetObj = s3Client.GetObject
 	s3PutObj = s3Uploader.Upload
 	s3CopyObj = s3Client.CopyObject
+	s3DeleteObj = s3Client.DeleteObject
 	s3GetObjReq = s3Client.GetObjectRequest
+	s3ListObjs = s3Client.ListObjects
 	snsPublish = snsClient.Publish
+	sqsSend = sqsClient.SendMessage
+	lambdaInvoke = lambdaClient.Invoke
 }
 
 func getMessage(id string) (io.Reader, error) {
@@ -586,16 +758,41 @@ func getMessage(id string) (io.Reader, error) {
 	return obj.Body, nil
 }
 
-func presignMessage(id string) (string, error) {
-	p := path.Join(conf.Bucket.MsgPrefix, id)
+// presignKey returns a short lived presigned GET url for a key in
+// the message bucket.
+func presignKey(key string) (string, error) {
+	url, _, err := presignKeyFor(key, 5*time.Minute, nil)
+	return url, err
+}
+
+// presignKeyFor returns a presigned GET url for a key in the message
+// bucket and how long it is valid for. A url signed with temporary
+// credentials stops working when the credentials expire, so ttl is
+// shortened to their expiry when the credentials report one.
+// Credentials read from the environment, as in lambda, don't, and
+// their urls are returned with the full ttl. If creds is set the url
+// is signed with it instead of the function's credentials.
+func presignKeyFor(key string, ttl time.Duration, creds *credentials.Credentials) (string, time.Duration, error) {
 	getObj := &s3.GetObjectInput{
 		Bucket: &conf.Bucket.Name,
-		Key:    &p,
+		Key:    &key,
 	}
 
 	req, _ := s3GetObjReq(getObj)
+	if creds != nil {
+		req.Config.Credentials = creds
+	}
+
+	if creds := req.Config.Credentials; creds != nil {
+		if expires, err := creds.ExpiresAt(); err == nil && !expires.IsZero() {
+			if left := time.Until(expires); left < ttl {
+				ttl = left
+			}
+		}
+	}
 
-	return req.Presign(5 * time.Minute)
+	url, err := req.Presign(ttl)
+	return url, ttl, err
 }
 
 func getForwardInfo(id string) (forwardInfo, error) {
@@ -674,53 +871,277 @@ func strList(strs []string) []*string {
 }
 
 func main() {
-	lambda.Start(Handler)
+	if len(os.Args) > 1 && os.Args[1] == "route-test" {
+		if err := routeTestCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "route-test: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	lambda.Start(handleEvent)
 }
 
 const privateAddrPlaceholder = "__PRIVATE_ADDRESS__"
 
-func (r *Route) Match(toHeader []string, from string) (bool, error) {
-	// TODO(PMS):
-	// - match other things like subject and body
+// routeMsg is the view of an incoming message that routing rules are
+// evaluated against.
+type routeMsg struct {
+	from string
+	// to is the To header. Routes match dst against the recipient
+	// set they select with recipients.
+	to []string
+	cc []string
+	// envelope is the SMTP envelope recipients, including Bcc
+	// recipients that don't appear in any header
+	envelope []string
+	subject  string
+	size     int
+	env      *enmime.Envelope
+}
+
+// Recipient sets a route can match dst against.
+const (
+	recipientsTo       = "to"
+	recipientsCc       = "cc"
+	recipientsBcc      = "bcc"
+	recipientsEnvelope = "envelope"
+	recipientsAny      = "any"
+)
 
-	src := r.Src
-	dst := r.Dst
-	if src == privateAddrPlaceholder {
-		src = conf.PrivateAccountAddress
+// recipients returns the recipient addresses selected by sel. Bcc
+// recipients are the envelope recipients not listed in To or Cc.
+func (msg routeMsg) recipients(sel string) []string {
+	switch sel {
+	case "", recipientsTo:
+		return msg.to
+	case recipientsCc:
+		return msg.cc
+	case recipientsEnvelope:
+		return msg.envelope
+	case recipientsBcc, recipientsAny:
+		seen := make(map[string]bool)
+		var all []string
+		for _, addr := range append(append([]string{}, msg.to...), msg.cc...) {
+			if parsed, err := gomail.ParseAddress(addr); err == nil {
+				seen[strings.ToLower(parsed.Address)] = true
+			}
+			all = append(all, addr)
+		}
+		var bcc []string
+		for _, addr := range msg.envelope {
+			if !seen[strings.ToLower(addr)] {
+				bcc = append(bcc, addr)
+			}
+		}
+		if sel == recipientsBcc {
+			return bcc
+		}
+		return append(all, bcc...)
 	}
+	return nil
+}
+
+// only returns a copy of msg whose recipient sets only contain addr.
+func (msg routeMsg) only(addr string) routeMsg {
+	keep := func(a string) bool { return strings.EqualFold(a, addr) }
+	msg.to = filterAddrs(msg.to, keep)
+	msg.cc = filterAddrs(msg.cc, keep)
+	msg.envelope = filterAddrs(msg.envelope, keep)
+	return msg
+}
 
-	if dst == privateAddrPlaceholder {
-		dst = conf.PrivateAccountAddress
+// without returns a copy of msg with addrs removed from its
+// recipient sets.
+func (msg routeMsg) without(addrs []string) routeMsg {
+	keep := func(a string) bool { return len(removeAddrs([]string{a}, addrs)) > 0 }
+	msg.to = filterAddrs(msg.to, keep)
+	msg.cc = filterAddrs(msg.cc, keep)
+	msg.envelope = filterAddrs(msg.envelope, keep)
+	return msg
+}
+
+// filterAddrs returns the entries of list whose address keep
+// reports true for. Entries that don't parse are dropped.
+func filterAddrs(list []string, keep func(addr string) bool) []string {
+	var out []string
+	for _, entry := range list {
+		if parsed, err := gomail.ParseAddress(entry); err == nil && keep(parsed.Address) {
+			out = append(out, entry)
+		}
 	}
+	return out
+}
 
-	var (
-		srcRe *regexp.Regexp
-		dstRe *regexp.Regexp
-		err   error
-	)
+// removeAddrs returns the addresses in list that are not in remove,
+// ignoring case.
+func removeAddrs(list, remove []string) []string {
+	var out []string
+	for _, addr := range list {
+		found := false
+		for _, r := range remove {
+			if strings.EqualFold(addr, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
 
-	err = buildRuleMatchRe(src, &srcRe)
-	if err != nil {
+// Match reports whether msg matches the route, testing dst against
+// the route's selected recipients.
+func (r *Route) Match(msg routeMsg) (bool, error) {
+	msg.to = msg.recipients(r.Recipients)
+	return r.Condition.Match(msg)
+}
+
+// Match reports whether msg satisfies every test set on c,
+// including any nested all/any/not conditions. An empty condition
+// never matches.
+func (c *Condition) Match(msg routeMsg) (bool, error) {
+	if c.isEmpty() {
+		return false, nil
+	}
+	if !c.compiled {
+		return false, errors.New("condition has not been compiled")
+	}
+
+	match, err := c.matchFields(msg)
+	if err != nil || !match {
 		return false, err
 	}
 
-	if !fuzzyMatchAddr(from, srcRe, src) {
+	for i := range c.All {
+		match, err = c.All[i].Match(msg)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+
+	if len(c.Any) > 0 {
+		var anyMatch bool
+		for i := range c.Any {
+			anyMatch, err = c.Any[i].Match(msg)
+			if err != nil {
+				return false, err
+			}
+			if anyMatch {
+				break
+			}
+		}
+		if !anyMatch {
+			return false, nil
+		}
+	}
+
+	if c.Not != nil {
+		match, err = c.Not.Match(msg)
+		if err != nil || match {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (c *Condition) matchFields(msg routeMsg) (bool, error) {
+	if c.src != nil && !c.src.matchAddr(msg.from) {
 		return false, nil
 	}
 
-	err = buildRuleMatchRe(dst, &dstRe)
-	if err != nil {
-		return false, err
+	if c.dst != nil {
+		var match bool
+		for _, toAddr := range msg.to {
+			if match = c.dst.matchAddr(toAddr); match {
+				break
+			}
+		}
+		if !match {
+			return false, nil
+		}
 	}
 
-	var match bool
-	for _, toAddr := range toHeader {
-		if match = fuzzyMatchAddr(toAddr, dstRe, dst); match == true {
-			break
+	if c.subject != nil && !c.subject.matchText(msg.subject) {
+		return false, nil
+	}
+
+	for _, h := range c.Header {
+		if !h.match(msg.env) {
+			return false, nil
+		}
+	}
+
+	if c.body != nil {
+		if msg.env == nil {
+			return false, nil
+		}
+		match := c.body.matchText(msg.env.Text)
+		if !match && msg.env.HTML != "" {
+			match = c.body.matchText(msg.env.HTML)
+		}
+		if !match {
+			return false, nil
 		}
 	}
 
-	return match, nil
+	return true, nil
+}
+
+func (h *HeaderMatch) match(env *enmime.Envelope) bool {
+	if env == nil {
+		return false
+	}
+
+	values := env.GetHeaderValues(h.Name)
+	if h.value == nil {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if h.value.matchText(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pattern is a compiled rule pattern. Patterns wrapped in slashes
+// are regular expressions.
+type pattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+// compilePattern compiles text, returning nil for an empty pattern.
+func compilePattern(text string) (*pattern, error) {
+	if text == "" {
+		return nil, nil
+	}
+	p := &pattern{text: text}
+	if err := buildRuleMatchRe(text, &p.re); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// matchAddr matches the address in addr exactly, or against the
+// regular expression.
+func (p *pattern) matchAddr(addr string) bool {
+	return fuzzyMatchAddr(addr, p.re, p.text)
+}
+
+// matchText matches text against the regular expression, or
+// as a case insensitive substring.
+func (p *pattern) matchText(text string) bool {
+	if p.re != nil {
+		return p.re.MatchString(text)
+	}
+	return strings.Contains(strings.ToLower(text), strings.ToLower(p.text))
 }
 
 func fuzzyMatchAddr(addr string, matchRe *regexp.Regexp, matchText string) bool {
@@ -739,13 +1160,13 @@ func fuzzyMatchAddr(addr string, matchRe *regexp.Regexp, matchText string) bool
 
 func buildRuleMatchRe(addr string, re **regexp.Regexp) error {
 	origAddr := addr
-	if strings.HasPrefix(addr, "/") && strings.HasSuffix(addr, "/") {
+	if len(addr) > 1 && strings.HasPrefix(addr, "/") && strings.HasSuffix(addr, "/") {
 		addr = strings.TrimPrefix(addr, "/")
 		addr = strings.TrimSuffix(addr, "/")
 
 		addrRe, err := regexp.Compile(addr)
 		if err != nil {
-			return fmt.Errorf("addr regexp compile err for %s: %w", origAddr, err)
+			return fmt.Errorf("regexp compile err for %s: %w", origAddr, err)
 		}
 
 		*re = addrRe
@@ -10,8 +10,10 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,10 +23,12 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/request"
+	awslambda "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/go-test/deep"
 	"github.com/jhillyerd/enmime"
 	"github.com/psanford/lambda-email/snsmsg"
@@ -41,19 +45,29 @@ func TestLambdaEmail(t *testing.T) {
 		},
 		Routes: []Route{
 			{
-				Src:     "psanford@example.com",
-				Dst:     "test@my-ses-email-domain.example.com",
+				Condition: Condition{
+					Src: "psanford@example.com",
+					Dst: "test@my-ses-email-domain.example.com",
+				},
 				SNS:     "hornet-breakwaters",
+				SQS:     []string{"https://sqs.us-east-1.amazonaws.com/123456789012/hooray-swaddles", "https://sqs.us-east-1.amazonaws.com/123456789012/quiver-oddball"},
+				Lambda:  []string{"arn:aws:lambda:us-east-1:123456789012:function:lentil-cascade"},
 				Forward: true,
 			},
 		},
 	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
 	sendEmail = fakeSendEmail
 	s3GetObj = fakeGetObj
 	s3PutObj = fakePutObj
 	s3CopyObj = fakeCopyObj
+	s3DeleteObj = fakeDeleteObj
 	s3GetObjReq = fakeGetObjReq
 	snsPublish = fakeSNSPublish
+	sqsSend = fakeSQSSend
+	lambdaInvoke = fakeLambdaInvoke
 
 	log.SetOutput(ioutil.Discard)
 
@@ -148,21 +162,41 @@ func TestLambdaEmail(t *testing.T) {
 	if len(snsMessages) != 1 {
 		log.Fatalf("Expected 1 sns publish but got %d", len(snsMessages))
 	}
+
+	if len(sqsMessages) != 2 {
+		t.Fatalf("Expected 2 sqs messages but got %d", len(sqsMessages))
+	}
+	if sqsMessages[1].target != "https://sqs.us-east-1.amazonaws.com/123456789012/quiver-oddball" {
+		t.Errorf("Unexpected sqs queue %s", sqsMessages[1].target)
+	}
+
+	if len(lambdaInvocations) != 1 {
+		t.Fatalf("Expected 1 lambda invocation but got %d", len(lambdaInvocations))
+	}
+
+	for _, msg := range []snsmsg.Msg{sqsMessages[0].msg, lambdaInvocations[0].msg} {
+		if diff := deep.Equal(msg, snsMessages[0]); diff != nil {
+			t.Error(diff)
+		}
+	}
 }
 
 func TestRuleMatch(t *testing.T) {
 	r := Route{
-		Src:  "furriest@imperative.blowsy.mustachio",
-		Dst:  "/.*/",
+		Condition: Condition{
+			Src: "furriest@imperative.blowsy.mustachio",
+			Dst: "/.*/",
+		},
 		Drop: true,
 	}
+	r.Condition = compileCondition(t, r.Condition)
 
 	var (
 		to   = "smithereens@reuses.bloodhounds"
 		from = "Steve Mustachio <furriest@imperative.blowsy.mustachio>"
 	)
 
-	match, err := r.Match([]string{to}, from)
+	match, err := r.Match(routeMsg{from: from, to: []string{to}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,12 +205,460 @@ func TestRuleMatch(t *testing.T) {
 	}
 }
 
+func TestRuleMatchContent(t *testing.T) {
+	raw := "From: Order Desk <orders@shop.example.com>\r\n" +
+		"To: shop@my-ses-email-domain.example.com\r\n" +
+		"Subject: Your order #1234 has shipped\r\n" +
+		"List-Id: <deals.shop.example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Thanks for your Order Confirmation request.\r\n"
+
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := routeMsg{
+		from:    "orders@shop.example.com",
+		to:      []string{"shop@my-ses-email-domain.example.com"},
+		subject: env.GetHeader("Subject"),
+		env:     env,
+	}
+
+	checks := []struct {
+		name   string
+		cond   Condition
+		expect bool
+	}{
+		{"subject_literal", Condition{Src: "/.*/", Dst: "/.*/", Subject: "HAS SHIPPED"}, true},
+		{"subject_regex", Condition{Src: "/.*/", Dst: "/.*/", Subject: "/order #[0-9]+/"}, true},
+		{"subject_miss", Condition{Src: "/.*/", Dst: "/.*/", Subject: "invoice"}, false},
+		{"header_exists", Condition{Src: "/.*/", Dst: "/.*/", Header: []HeaderMatch{{Name: "list-id"}}}, true},
+		{"header_value", Condition{Src: "/.*/", Dst: "/.*/", Header: []HeaderMatch{{Name: "List-Id", Value: "/deals\\./"}}}, true},
+		{"header_missing", Condition{Src: "/.*/", Dst: "/.*/", Header: []HeaderMatch{{Name: "List-Unsubscribe"}}}, false},
+		{"body_literal", Condition{Src: "/.*/", Dst: "/.*/", Body: "order confirmation"}, true},
+		{"body_miss", Condition{Src: "/.*/", Dst: "/.*/", Body: "/unsubscribe/"}, false},
+		{"dst_miss", Condition{Src: "/.*/", Dst: "other@my-ses-email-domain.example.com", Subject: "shipped"}, false},
+	}
+
+	for _, c := range checks {
+		cond := compileCondition(t, c.cond)
+		match, err := cond.Match(msg)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if match != c.expect {
+			t.Errorf("%s: got match=%t expected %t", c.name, match, c.expect)
+		}
+	}
+
+	_, err = (&Condition{Src: "/.*/", Dst: "/.*/", Subject: "/[/"}).compile("route", "")
+	if err == nil {
+		t.Errorf("Expected error for invalid subject regexp")
+	}
+}
+
+func TestRuleMatchGroups(t *testing.T) {
+	conf = &Config{
+		PrivateAccountAddress: "me@gmail.example.com",
+	}
+
+	// to sales@ or billing@, but not from the private address
+	r := Route{
+		Condition: Condition{
+			Any: []Condition{
+				{Dst: "sales@my-ses-email-domain.example.com"},
+				{Dst: "billing@my-ses-email-domain.example.com"},
+			},
+			Not: &Condition{
+				Src: privateAddrPlaceholder,
+			},
+		},
+	}
+	r.Condition = compileCondition(t, r.Condition)
+
+	checks := []struct {
+		from   string
+		to     string
+		expect bool
+	}{
+		{"a@example.com", "sales@my-ses-email-domain.example.com", true},
+		{"a@example.com", "billing@my-ses-email-domain.example.com", true},
+		{"a@example.com", "support@my-ses-email-domain.example.com", false},
+		{"me@gmail.example.com", "sales@my-ses-email-domain.example.com", false},
+	}
+
+	for _, c := range checks {
+		match, err := r.Match(routeMsg{from: c.from, to: []string{c.to}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != c.expect {
+			t.Errorf("from=%s to=%s: got match=%t expected %t", c.from, c.to, match, c.expect)
+		}
+	}
+
+	all := Condition{
+		All: []Condition{
+			{Src: "/@example\\.com$/"},
+			{Not: &Condition{Subject: "unsubscribe"}},
+		},
+	}
+	all = compileCondition(t, all)
+	match, err := all.Match(routeMsg{from: "a@example.com", subject: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match {
+		t.Errorf("Expected all condition to match")
+	}
+
+	var empty Condition
+	match, err = empty.Match(routeMsg{from: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match {
+		t.Errorf("Expected empty condition to not match")
+	}
+}
+
+func TestRuleMatchRecipients(t *testing.T) {
+	conf = &Config{
+		PrivateAccountAddress: "me@gmail.example.com",
+	}
+
+	msg := routeMsg{
+		from: "a@example.com",
+		to:   []string{"Sales <sales@my-ses-email-domain.example.com>"},
+		cc:   []string{"billing@my-ses-email-domain.example.com"},
+		envelope: []string{
+			"sales@my-ses-email-domain.example.com",
+			"billing@my-ses-email-domain.example.com",
+			"list@my-ses-email-domain.example.com",
+		},
+	}
+
+	checks := []struct {
+		recipients string
+		dst        string
+		expect     bool
+	}{
+		{"", "sales@my-ses-email-domain.example.com", true},
+		{"", "billing@my-ses-email-domain.example.com", false},
+		{"to", "list@my-ses-email-domain.example.com", false},
+		{"cc", "billing@my-ses-email-domain.example.com", true},
+		{"cc", "sales@my-ses-email-domain.example.com", false},
+		{"bcc", "list@my-ses-email-domain.example.com", true},
+		{"bcc", "billing@my-ses-email-domain.example.com", false},
+		{"envelope", "billing@my-ses-email-domain.example.com", true},
+		{"any", "list@my-ses-email-domain.example.com", true},
+		{"any", "sales@my-ses-email-domain.example.com", true},
+		{"any", "other@my-ses-email-domain.example.com", false},
+	}
+
+	for _, c := range checks {
+		r := Route{
+			Condition:  compileCondition(t, Condition{Dst: c.dst}),
+			Recipients: c.recipients,
+		}
+		match, err := r.Match(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != c.expect {
+			t.Errorf("recipients=%s dst=%s: got match=%t expected %t", c.recipients, c.dst, match, c.expect)
+		}
+	}
+}
+
+func TestRouteOrder(t *testing.T) {
+	queue := func(name string) string {
+		return "https://sqs.us-east-1.amazonaws.com/123456789012/" + name
+	}
+	route := func(name string, priority int, stop bool) Route {
+		return Route{
+			Condition: Condition{Src: "/.*/"},
+			SQS:       []string{queue(name)},
+			Priority:  priority,
+			Stop:      stop,
+		}
+	}
+
+	checks := []struct {
+		name   string
+		routes []Route
+		expect []string
+	}{
+		{
+			name:   "file_order_continue",
+			routes: []Route{route("a", 0, false), route("b", 0, false)},
+			expect: []string{queue("a"), queue("b")},
+		},
+		{
+			name:   "stop",
+			routes: []Route{route("a", 0, true), route("b", 0, false)},
+			expect: []string{queue("a")},
+		},
+		{
+			name:   "priority",
+			routes: []Route{route("a", 0, false), route("b", 5, true), route("c", 5, false)},
+			expect: []string{queue("b")},
+		},
+		{
+			name: "drop_after_action",
+			routes: []Route{
+				route("a", 0, false),
+				{Condition: Condition{Src: "/.*/"}, Drop: true},
+				route("b", 0, false),
+			},
+			expect: []string{queue("a")},
+		},
+		{
+			name: "priority_drop",
+			routes: []Route{
+				route("a", 0, false),
+				{Condition: Condition{Src: "/.*/"}, Drop: true, Priority: 1},
+			},
+		},
+		{
+			name: "stop_skips_non_matching",
+			routes: []Route{
+				{Condition: Condition{Dst: "nobody@my-ses-email-domain.example.com"}, SQS: []string{queue("a")}, Stop: true, Priority: 1},
+				route("b", 0, false),
+			},
+			expect: []string{queue("b")},
+		},
+	}
+
+	for _, c := range checks {
+		conf = &Config{
+			Domain:                "my-ses-email-domain.example.com",
+			PrivateAccountAddress: "foo@gmail.example.com",
+			Bucket: Bucket{
+				Name:              "westerly-tapir",
+				MsgPrefix:         "/periphery-corollas",
+				ForwardMetaPrefix: "/Voldemort-wearily",
+			},
+			Routes: c.routes,
+		}
+		if err := conf.compile(); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		sendEmail = fakeSendEmail
+		s3GetObj = fakeGetObj
+		s3PutObj = fakePutObj
+		s3GetObjReq = fakeGetObjReq
+		sqsSend = fakeSQSSend
+
+		log.SetOutput(ioutil.Discard)
+
+		sse := loadTestEvent(t)
+		putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+
+		sentEmails = nil
+		sqsMessages = nil
+
+		if err := Handler(sse); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		var got []string
+		for _, m := range sqsMessages {
+			got = append(got, m.target)
+		}
+		if diff := deep.Equal(got, c.expect); diff != nil {
+			t.Errorf("%s: %v", c.name, diff)
+		}
+		if len(sentEmails) != 0 {
+			t.Errorf("%s: expected message not to be forwarded", c.name)
+		}
+	}
+}
+
+func TestValidateRouteConditions(t *testing.T) {
+	base := Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "me@gmail.example.com",
+		OutboundAddress:       "outbound@my-ses-email-domain.example.com",
+		AwsRegion:             "us-east-1",
+		Bucket: Bucket{
+			Name:              "b",
+			MsgPrefix:         "/email",
+			ForwardMetaPrefix: "/meta",
+			OutboxPrefix:      "/outbox",
+		},
+	}
+
+	checks := []struct {
+		name  string
+		cond  Condition
+		valid bool
+	}{
+		{"leaf", Condition{Src: "/.*/", Dst: "a@my-ses-email-domain.example.com"}, true},
+		{"nested", Condition{Src: "/.*/", Any: []Condition{{Dst: "/.*/"}}, Not: &Condition{Body: "x"}}, true},
+		{"dst_only", Condition{Dst: "a@my-ses-email-domain.example.com"}, true},
+		{"subject_only", Condition{Subject: "invoice"}, true},
+		{"nested_only", Condition{Any: []Condition{{Src: "/.*/"}}}, true},
+		{"empty", Condition{}, false},
+		{"empty_not", Condition{Src: "/.*/", Not: &Condition{}}, false},
+		{"empty_any", Condition{Src: "/.*/", Any: []Condition{{Dst: "/.*/"}, {}}}, false},
+		{"bad_regex", Condition{Src: "/.*/", All: []Condition{{Subject: "/(/"}}}, false},
+		{"header_no_name", Condition{Src: "/.*/", Header: []HeaderMatch{{Value: "x"}}}, false},
+	}
+
+	for _, c := range checks {
+		conf := base
+		conf.Routes = []Route{{Condition: c.cond}}
+		err := conf.validate()
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected err: %s", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected validation error", c.name)
+		}
+	}
+
+	conf := base
+	conf.Routes = []Route{{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, Recipients: "reply-to"}}
+	if err := conf.validate(); err == nil {
+		t.Errorf("expected unknown recipients to fail validation")
+	}
+
+	conf.Routes = []Route{{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, Forward: true}}
+	if err := conf.validate(); err == nil {
+		t.Errorf("expected route without actions to fail validation")
+	}
+
+	conf.Routes = []Route{{Name: "a&b", Condition: Condition{Src: "/.*/", Dst: "/.*/"}}}
+	if err := conf.validate(); err == nil {
+		t.Errorf("expected invalid route name to fail validation")
+	}
+
+	conf.Routes = []Route{
+		{Condition: Condition{Src: "/.*/", Dst: "/.*/"}, SNS: "arn:aws:sns:us-east-1:123456789012:a", Forward: true},
+		{Condition: Condition{Src: "/.*/", Any: []Condition{{Src: privateAddrPlaceholder}}}, Priority: 1},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.routes) != 2 || conf.routes[0].Priority != 1 || !conf.routes[0].Any[0].compiled {
+		t.Errorf("expected a compiled route table in priority order, got %+v", conf.routes)
+	}
+	if conf.Routes[1].Any[0].compiled {
+		t.Errorf("compile should not modify the configured routes")
+	}
+}
+
+// expiringProvider is a credentials provider that reports when its
+// credentials expire, like an assumed role session.
+type expiringProvider struct {
+	expires time.Time
+}
+
+func (p *expiringProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "SECRET", SessionToken: "TOKEN", ProviderName: "expiring"}, nil
+}
+
+func (p *expiringProvider) IsExpired() bool {
+	return time.Now().After(p.expires)
+}
+
+func (p *expiringProvider) ExpiresAt() time.Time {
+	return p.expires
+}
+
+func TestPresignKeyForExpiringCredentials(t *testing.T) {
+	conf = &Config{Bucket: Bucket{Name: "westerly-tapir"}}
+
+	s3GetObjReq = fakeGetObjReq
+	if _, ttl, err := presignKeyFor("/periphery-corollas/a", 24*time.Hour, nil); err != nil || ttl != 24*time.Hour {
+		t.Errorf("expected static credentials to keep the ttl, got %s err=%v", ttl, err)
+	}
+
+	creds := credentials.NewCredentials(&expiringProvider{expires: time.Now().Add(time.Hour)})
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	s3GetObjReq = func(in *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+		req, out := fakeGetObjReq(in)
+		req.Config.Credentials = creds
+		return req, out
+	}
+	defer func() {
+		s3GetObjReq = fakeGetObjReq
+	}()
+
+	_, ttl, err := presignKeyFor("/periphery-corollas/a", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl > time.Hour || ttl < 59*time.Minute {
+		t.Errorf("expected ttl to be shortened to the credential expiry, got %s", ttl)
+	}
+
+	// long lived digest link credentials replace the expiring ones
+	os.Setenv("DIGEST_LINK_ACCESS_KEY_ID", "AKIDLINK")
+	os.Setenv("DIGEST_LINK_SECRET_ACCESS_KEY", "SECRET")
+	defer func() {
+		os.Unsetenv("DIGEST_LINK_ACCESS_KEY_ID")
+		os.Unsetenv("DIGEST_LINK_SECRET_ACCESS_KEY")
+	}()
+	_, ttl, err = presignKeyFor("/periphery-corollas/a", digestLinkTTL, digestLinkCredentials())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != digestLinkTTL {
+		t.Errorf("expected link signed with the digest credentials to keep the ttl %s, got %s", digestLinkTTL, ttl)
+	}
+}
+
+func TestDigestLinkWarning(t *testing.T) {
+	c := &Config{Routes: []Route{{Digest: digestDaily}}}
+	if c.digestLinkWarning() == "" {
+		t.Errorf("expected a warning for digest links signed with temporary credentials")
+	}
+
+	os.Setenv("DIGEST_LINK_ACCESS_KEY_ID", "AKIDLINK")
+	os.Setenv("DIGEST_LINK_SECRET_ACCESS_KEY", "SECRET")
+	defer func() {
+		os.Unsetenv("DIGEST_LINK_ACCESS_KEY_ID")
+		os.Unsetenv("DIGEST_LINK_SECRET_ACCESS_KEY")
+	}()
+	if w := c.digestLinkWarning(); w != "" {
+		t.Errorf("expected no warning with digest link credentials got %q", w)
+	}
+}
+
+func compileCondition(t *testing.T, c Condition) Condition {
+	t.Helper()
+
+	var privateAddr string
+	if conf != nil {
+		privateAddr = conf.PrivateAccountAddress
+	}
+
+	compiled, err := c.compile("test", privateAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compiled
+}
+
 var (
-	fakeS3      = make(map[bucketKey][]byte)
-	sentEmails  []sentEmail
-	snsMessages []snsmsg.Msg
+	fakeS3            = make(map[bucketKey][]byte)
+	sentEmails        []sentEmail
+	sentBounces       []*ses.SendBounceInput
+	snsMessages       []snsmsg.Msg
+	sqsMessages       []routedMsg
+	lambdaInvocations []routedMsg
 )
 
+type routedMsg struct {
+	target string
+	msg    snsmsg.Msg
+}
+
 type sentEmail struct {
 	input  *ses.SendRawEmailInput
 	sendID string
@@ -207,6 +689,11 @@ func fakeSendEmail(i *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
 
 }
 
+func fakeSendBounce(i *ses.SendBounceInput) (*ses.SendBounceOutput, error) {
+	sentBounces = append(sentBounces, i)
+	return &ses.SendBounceOutput{}, nil
+}
+
 func fakeGetObj(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	key := bucketKey{*i.Bucket, *i.Key}
 	if obj, found := fakeS3[key]; found {
@@ -239,6 +726,11 @@ func fakeCopyObj(i *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
 	dst := bucketKey{*i.Bucket, *i.Key}
 
 	obj, ok := fakeS3[src]
+	if !ok {
+		// CopySource joins the bucket and key so a leading slash on
+		// the key is lost
+		obj, ok = fakeS3[bucketKey{srcBucket, "/" + srcPath}]
+	}
 	if !ok {
 		return nil, awserr.New(s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchKey, nil)
 	}
@@ -247,6 +739,27 @@ func fakeCopyObj(i *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
 	return &s3.CopyObjectOutput{}, nil
 }
 
+func fakeDeleteObj(i *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(fakeS3, bucketKey{*i.Bucket, *i.Key})
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func fakeListObjs(i *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	var keys []string
+	for k := range fakeS3 {
+		if k.bucket == *i.Bucket && strings.HasPrefix(k.key, aws.StringValue(i.Prefix)) && k.key > aws.StringValue(i.Marker) {
+			keys = append(keys, k.key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsOutput{IsTruncated: aws.Bool(false)}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
 func fakeGetObjReq(*s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
 	op := &request.Operation{}
 
@@ -274,3 +787,27 @@ func fakeSNSPublish(i *sns.PublishInput) (*sns.PublishOutput, error) {
 	snsMessages = append(snsMessages, msg)
 	return nil, nil
 }
+
+func fakeSQSSend(i *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	var msg snsmsg.Msg
+
+	err := json.Unmarshal([]byte(*i.MessageBody), &msg)
+	if err != nil {
+		panic(err)
+	}
+
+	sqsMessages = append(sqsMessages, routedMsg{target: *i.QueueUrl, msg: msg})
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func fakeLambdaInvoke(i *awslambda.InvokeInput) (*awslambda.InvokeOutput, error) {
+	var msg snsmsg.Msg
+
+	err := json.Unmarshal(i.Payload, &msg)
+	if err != nil {
+		panic(err)
+	}
+
+	lambdaInvocations = append(lambdaInvocations, routedMsg{target: *i.FunctionName, msg: msg})
+	return &awslambda.InvokeOutput{}, nil
+}
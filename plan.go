@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	gomail "net/mail"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/registry"
+	"github.com/psanford/lambda-email/snsmsg"
+)
+
+type actionKind string
+
+const (
+	// carry out a policy decision instead of processing the message
+	actionPolicy actionKind = "policy"
+	// notify the private address that the message was not forwarded
+	actionErrorEmail actionKind = "error_email"
+	// handle a RELEASE or PURGE reply to a quarantine notice
+	actionQuarantineCommand actionKind = "quarantine_command"
+
+	actionSNS     actionKind = "sns"
+	actionSQS     actionKind = "sqs"
+	actionWebhook actionKind = "webhook"
+	actionLambda  actionKind = "lambda"
+
+	// forward the message to the private account
+	actionForward actionKind = "forward"
+	// store the message in the outbox
+	actionOutbound actionKind = "outbound"
+	// send a reply from the private account to the original sender
+	actionReply actionKind = "reply"
+	// forward the message to the members of a group
+	actionGroup actionKind = "group"
+	// send a short notification for a vip message
+	actionVIPNotify actionKind = "vip_notify"
+	// add extracted codes and links to route payloads; runs before
+	// the other route actions
+	actionExtract actionKind = "extract"
+	// save an attachment to the bucket; runs before the other route
+	// actions so their payloads include it
+	actionAttachment actionKind = "attachment"
+	// copy the message to an archive key
+	actionArchive actionKind = "archive"
+	// add the message to an atom feed
+	actionFeed actionKind = "feed"
+	// hold a reference to the message for a scheduled digest
+	actionDigest actionKind = "digest"
+	// send an automatic reply to the sender
+	actionAutoreply actionKind = "autoreply"
+	// register the recipient alias or update its last used time
+	actionAlias actionKind = "alias"
+	// reject the message back to the sender
+	actionBounce actionKind = "bounce"
+	// do nothing; records why the message is not delivered
+	actionDiscard actionKind = "discard"
+)
+
+// action is a single step in a recordPlan.
+type action struct {
+	kind actionKind
+	// target is the sns topic, sqs queue url, webhook url, lambda
+	// function or forwarding address, depending on kind
+	target string
+	// route is the name of the route the action came from
+	route      string
+	webhook    Webhook
+	bounce     *Bounce
+	autoreply  *Autoreply
+	feed       *Feed
+	attachment plannedAttachment
+	group      *Group
+	members    []string
+	// recipients are the recipients a bounce action bounces
+	recipients []string
+	extracted  extracted
+	// subjectPrefix puts the first extracted code in the forwarded
+	// subject
+	subjectPrefix bool
+	// registered is the existing registry entry for an alias action
+	registered *registry.Alias
+	policy     policyDecision
+	reason     string
+}
+
+func (a action) String() string {
+	switch a.kind {
+	case actionPolicy:
+		return fmt.Sprintf("policy %s (failed: %s)", a.policy.action, strings.Join(a.policy.failed(), ","))
+	case actionErrorEmail:
+		return "error email: " + a.reason
+	case actionQuarantineCommand:
+		return "quarantine command from " + a.target
+	case actionSNS:
+		return "sns publish " + a.target
+	case actionSQS:
+		return "sqs send " + a.target
+	case actionWebhook:
+		return "webhook " + a.target
+	case actionLambda:
+		return "lambda invoke " + a.target
+	case actionForward:
+		if a.reason != "" {
+			return fmt.Sprintf("forward to %s (%s)", a.target, a.reason)
+		}
+		return "forward to " + a.target
+	case actionOutbound:
+		return "store in outbox"
+	case actionReply:
+		return "reply from " + a.target
+	case actionGroup:
+		return fmt.Sprintf("group %s to %s", a.target, strings.Join(a.members, ","))
+	case actionVIPNotify:
+		return "vip notify " + a.target
+	case actionExtract:
+		return fmt.Sprintf("extract codes=[%s] links=[%s]", strings.Join(a.extracted.codes, ","), strings.Join(a.extracted.links, " "))
+	case actionAttachment:
+		return fmt.Sprintf("save attachment %q to %s", a.attachment.part.FileName, a.target)
+	case actionArchive:
+		return "archive to " + a.target
+	case actionFeed:
+		return "add to feed " + a.target
+	case actionDigest:
+		return "add to " + a.target + " digest"
+	case actionAutoreply:
+		return "autoreply to " + a.target
+	case actionAlias:
+		if a.registered == nil {
+			return "register alias " + a.target
+		}
+		return "update alias " + a.target
+	case actionBounce:
+		return fmt.Sprintf("bounce %s to %s", a.bounce, strings.Join(a.recipients, ","))
+	case actionDiscard:
+		return "discard (" + a.reason + ")"
+	}
+	return string(a.kind)
+}
+
+// recordPlan is the list of actions to take for a single SES record.
+type recordPlan struct {
+	record  events.SimpleEmailRecord
+	body    *enmime.Envelope
+	policy  policyDecision
+	actions []action
+
+	// attachments saved and codes and links extracted so far, set
+	// during execution
+	attachments []snsmsg.Attachment
+	extracted   extracted
+	// forward adjusts forwarded messages
+	forward forwardOptions
+}
+
+// msg returns the payload for route integrations.
+func (p *recordPlan) msg() (snsmsg.Msg, error) {
+	msg, err := newMsg(p.record)
+	if err != nil {
+		return msg, err
+	}
+	msg.Attachments = p.attachments
+	msg.Codes = p.extracted.codes
+	msg.Links = p.extracted.links
+	return msg, nil
+}
+
+func (p *recordPlan) add(a action) {
+	p.actions = append(p.actions, a)
+}
+
+func (p *recordPlan) log(lgr log15.Logger) {
+	actions := make([]string, len(p.actions))
+	for i, a := range p.actions {
+		actions[i] = a.String()
+	}
+	lgr.Info("plan", "policy", p.policy.action, "actions", strings.Join(actions, "; "))
+}
+
+// planner decides what to do with a record without causing any side
+// effects. getMessage returns the raw message for an SES message id,
+// released reports whether a quarantined message has been released,
+// members returns a group's member addresses, forwarded reports
+// whether an SES message id is one of our forwarded messages and
+// alias returns the registry entry for an alias, or nil if it is not
+// registered.
+type planner struct {
+	lgr        log15.Logger
+	getMessage func(id string) ([]byte, error)
+	released   func(id string) bool
+	members    func(g *Group) ([]string, error)
+	forwarded  func(id string) bool
+	alias      func(addr string) (*registry.Alias, error)
+}
+
+// s3Planner returns a planner that reads messages and quarantine
+// state from the message bucket.
+func s3Planner(lgr log15.Logger) *planner {
+	return &planner{
+		lgr: lgr,
+		getMessage: func(id string) ([]byte, error) {
+			r, err := getMessage(id)
+			if err != nil {
+				return nil, fmt.Errorf("GetMessage err=%q", err)
+			}
+			raw, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("Read email err=%q", err)
+			}
+			return raw, nil
+		},
+		released: func(id string) bool {
+			return quarantineReleased(lgr, id)
+		},
+		members: groupMembers,
+		forwarded: func(id string) bool {
+			_, err := getForwardInfo(id)
+			return err == nil
+		},
+		alias: getAlias,
+	}
+}
+
+func (pl *planner) plan(record events.SimpleEmailRecord) (*recordPlan, error) {
+	var (
+		lgr          = pl.lgr
+		mail         = record.SES.Mail
+		receipt      = record.SES.Receipt
+		subject      = mail.CommonHeaders.Subject
+		toHeader     = mail.CommonHeaders.To
+		originalFrom = mail.CommonHeaders.From
+
+		fromAddr   string
+		toOutbound bool
+	)
+
+	p := &recordPlan{
+		record: record,
+		policy: decidePolicy(receipt, globalPolicyAction),
+	}
+
+	lgr.Info("got_message", "policy", p.policy.action, "failed_verdicts", p.policy.failed())
+
+	if p.policy.action == policyQuarantine && pl.released(mail.MessageID) {
+		lgr.Info("quarantine_released_forwarding")
+		p.policy.action = policyForward
+	}
+
+	switch p.policy.action {
+	case policyForward, policyTag:
+	default:
+		p.add(action{kind: actionPolicy, policy: p.policy})
+		return p, nil
+	}
+
+	if len(originalFrom) > 0 {
+		if addr, err := gomail.ParseAddress(originalFrom[0]); err == nil {
+			fromAddr = addr.Address
+		}
+	}
+
+	if strings.ToLower(fromAddr) == awsMailerDaemon {
+		p.add(action{kind: actionErrorEmail, reason: "aws mailer-daemon notification, not forwarding"})
+		return p, nil
+	}
+
+	for _, toAddr := range toHeader {
+		if addr, err := gomail.ParseAddress(toAddr); err == nil {
+			if addr.Address == conf.OutboundAddress {
+				toOutbound = true
+			}
+		}
+	}
+
+	raw, err := pl.getMessage(mail.MessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("Parse email err=%q", err)
+	}
+	p.body = body
+
+	routeMsg := routeMsg{
+		from:     fromAddr,
+		to:       toHeader,
+		envelope: mail.Destination,
+		subject:  subject,
+		size:     len(raw),
+		env:      body,
+	}
+	if cc, err := body.AddressList("Cc"); err == nil {
+		for _, addr := range cc {
+			routeMsg.cc = append(routeMsg.cc, addr.String())
+		}
+	}
+
+	if conf.isDestination(fromAddr) && proxyRecipient(record) == quarantineAddress() {
+		p.add(action{kind: actionQuarantineCommand, target: fromAddr})
+		return p, nil
+	}
+
+	// replies and outbound mail from our own addresses aren't checked
+	// against the registry
+	if conf.Aliases.Enabled && !conf.isDestination(fromAddr) {
+		done, err := pl.planAlias(p)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return p, nil
+		}
+		// disabled and bounced aliases are no longer recipients
+		record = p.record
+	}
+
+	routes, err := evalRoutes(lgr, routeMsg, record, func() bool {
+		return pl.released(mail.MessageID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range routes.matched {
+		if rule.Extract == nil {
+			continue
+		}
+		x, err := rule.Extract.extract(subject, body)
+		if err != nil {
+			return nil, err
+		}
+		p.add(action{kind: actionExtract, extracted: x, subjectPrefix: rule.Extract.SubjectPrefix, route: rule.Name})
+	}
+
+	for _, rule := range routes.matched {
+		if rule.Attachments == nil {
+			continue
+		}
+		attachments, err := rule.Attachments.plan(newKeyData(record), body)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attachments {
+			p.add(action{kind: actionAttachment, target: a.key, attachment: a, route: rule.Name})
+		}
+	}
+
+	for _, rule := range routes.matched {
+		if rule.SNS != "" {
+			p.add(action{kind: actionSNS, target: rule.SNS, route: rule.Name})
+		}
+		for _, queue := range rule.SQS {
+			p.add(action{kind: actionSQS, target: queue, route: rule.Name})
+		}
+		for _, wh := range rule.Webhook {
+			p.add(action{kind: actionWebhook, target: wh.URL, webhook: wh, route: rule.Name})
+		}
+		for _, function := range rule.Lambda {
+			p.add(action{kind: actionLambda, target: function, route: rule.Name})
+		}
+		if rule.Archive != nil {
+			key, err := rule.Archive.key(record)
+			if err != nil {
+				return nil, err
+			}
+			p.add(action{kind: actionArchive, target: key, route: rule.Name})
+		}
+		if rule.Feed != nil {
+			p.add(action{kind: actionFeed, target: rule.Feed.key(rule.Name), feed: rule.Feed, route: rule.Name})
+		}
+		if rule.Digest != "" {
+			p.add(action{kind: actionDigest, target: rule.Digest, route: rule.Name})
+		}
+		if rule.Autoreply != nil {
+			if reason := autoreplySuppressed(record, body, p.policy); reason != "" {
+				lgr.Info("autoreply_suppressed", "reason", reason)
+			} else {
+				p.add(action{kind: actionAutoreply, target: strings.Trim(mail.Source, "<>"), autoreply: rule.Autoreply, route: rule.Name})
+			}
+		}
+	}
+
+	if routes.dropped {
+		p.add(action{kind: actionDiscard, reason: "drop route"})
+		return p, nil
+	}
+
+	for _, b := range routes.bounces {
+		p.add(action{kind: actionBounce, bounce: b.bounce, recipients: b.recipients})
+	}
+	if len(routes.bounces) > 0 {
+		// the recipients that weren't bounced are processed normally
+		record.SES.Receipt.Recipients = routes.recipients
+		p.record = record
+		if proxyRecipient(record) == "" {
+			return p, nil
+		}
+	}
+
+	if routes.policy != nil {
+		p.add(action{kind: actionPolicy, policy: *routes.policy})
+		return p, nil
+	}
+
+	// a matched route's policy can tag a message the global policy
+	// would forward as is
+	if routes.decision != nil {
+		p.policy = p.policy.merge(*routes.decision)
+	}
+
+	skipForwarding := routes.skipForwarding
+
+	// dest is where messages to this alias are forwarded, and the
+	// only address replies from the alias are accepted from
+	dest := conf.destination(proxyRecipient(record))
+
+	if conf.sieve != nil {
+		result, err := conf.sieve.eval(routeMsg)
+		if err != nil {
+			return nil, err
+		}
+
+		lgr.Info("sieve_result", "keep", result.keep, "fileinto", result.fileinto, "redirect", result.redirect, "notify", result.notify)
+
+		for _, topic := range result.notify {
+			p.add(action{kind: actionSNS, target: topic, reason: "sieve"})
+		}
+
+		for _, folder := range result.fileinto {
+			p.add(action{kind: actionForward, target: tagAddr(dest, folder), reason: "sieve fileinto"})
+		}
+
+		for _, addr := range result.redirect {
+			if conf.ownsAddress(addr) {
+				lgr.Error("sieve_redirect_loop", "addr", addr)
+				continue
+			}
+			p.add(action{kind: actionForward, target: addr, reason: "sieve redirect"})
+		}
+
+		if !result.keep {
+			skipForwarding = true
+		}
+	}
+
+	group := conf.group(proxyRecipient(record))
+	outbound := fromAddr == conf.PrivateAccountAddress && toOutbound
+	reply := strings.EqualFold(fromAddr, dest)
+
+	// vip senders are checked independently of the routes, but only
+	// for messages that are delivered, so dropped, bounced and held
+	// messages and replies from the alias's owner never push. Suspect
+	// messages never count, so a forged sender can't trigger a push.
+	delivered := !skipForwarding && !outbound && !reply
+	if delivered && len(p.policy.failed()) == 0 && conf.VIP.match(fromAddr, routeMsg.recipients(recipientsAny)) {
+		lgr.Info("vip_message")
+		p.forward.vip = true
+		if conf.VIP.SNS != "" {
+			p.add(action{kind: actionVIPNotify, target: conf.VIP.SNS})
+		}
+	}
+
+	switch {
+	case skipForwarding:
+		p.add(action{kind: actionDiscard, reason: "skip forwarding"})
+	case outbound:
+		p.add(action{kind: actionOutbound})
+	case group != nil:
+		if err := pl.planGroup(p, group, fromAddr, body); err != nil {
+			return nil, err
+		}
+	case reply:
+		p.add(action{kind: actionReply, target: proxyRecipient(record)})
+	default:
+		proxyAddr := proxyRecipient(record)
+		if proxyAddr == "" {
+			return nil, fmt.Errorf("Failed to find %s address for email %s", conf.Domain, mail.MessageID)
+		}
+		localPart := strings.SplitN(proxyAddr, "@", 2)[0]
+		fwd := action{kind: actionForward, target: tagAddr(dest, localPart)}
+		if p.forward.vip {
+			fwd.reason = "vip"
+		}
+		p.add(fwd)
+	}
+
+	return p, nil
+}
+
+// planGroup adds the action for a message to a group alias. A
+// member's reply to a forwarded group message goes back to the
+// original sender; anything else is sent to the other members.
+func (pl *planner) planGroup(p *recordPlan, g *Group, fromAddr string, body *enmime.Envelope) error {
+	members, err := pl.members(g)
+	if err != nil {
+		return err
+	}
+
+	fromAddr = strings.ToLower(fromAddr)
+	var (
+		isMember   bool
+		recipients []string
+	)
+	for _, m := range members {
+		if m == fromAddr {
+			isMember = true
+			continue
+		}
+		recipients = append(recipients, m)
+	}
+
+	replyToID := strings.TrimSuffix(trimBrackets(body.GetHeader("In-Reply-To")), "@email.amazonses.com")
+	if isMember && replyToID != "" && pl.forwarded(replyToID) {
+		p.add(action{kind: actionReply, target: g.address(), reason: "group member reply"})
+		return nil
+	}
+
+	if len(recipients) == 0 {
+		p.add(action{kind: actionDiscard, reason: "no other group members"})
+		return nil
+	}
+
+	p.add(action{kind: actionGroup, target: g.address(), group: g, members: recipients})
+	return nil
+}
+
+// planAlias checks each of the message's recipients on the domain
+// against the alias registry and adds the actions for them. Disabled
+// and bounced aliases are removed from the plan's record so the other
+// recipients are processed normally. It reports whether the message
+// should not be processed any further.
+func (pl *planner) planAlias(p *recordPlan) (bool, error) {
+	var (
+		registered = make(map[string]*registry.Alias)
+		unknown    []string
+		removed    []string
+	)
+	for _, addr := range proxyRecipients(p.record) {
+		if conf.group(addr) != nil || addr == quarantineAddress() || strings.EqualFold(addr, conf.OutboundAddress) {
+			continue
+		}
+		a, err := pl.alias(addr)
+		if err != nil {
+			return false, err
+		}
+		if a == nil {
+			unknown = append(unknown, addr)
+		} else {
+			registered[addr] = a
+		}
+	}
+
+	if len(unknown) > 0 && conf.Aliases.unknown() == aliasQuarantine {
+		if !pl.released(p.record.SES.Mail.MessageID) {
+			p.add(action{kind: actionPolicy, policy: unknownAliasDecision})
+			return true, nil
+		}
+		pl.lgr.Info("unknown_alias_released")
+	}
+
+	for _, addr := range proxyRecipients(p.record) {
+		if a, ok := registered[addr]; ok {
+			if a.Status == registry.StatusDisabled {
+				p.add(action{kind: actionDiscard, reason: "alias disabled " + addr})
+				removed = append(removed, addr)
+			} else {
+				p.add(action{kind: actionAlias, target: addr, registered: a})
+			}
+		}
+	}
+
+	for _, addr := range unknown {
+		switch conf.Aliases.unknown() {
+		case aliasWarn:
+			p.forward.unknownAlias = true
+		case aliasBounce:
+			// bouncing mail with a forged sender sends backscatter to
+			// whoever was forged, so suspect messages are dropped
+			// instead
+			if len(p.policy.failed()) > 0 {
+				p.add(action{kind: actionDiscard, reason: "unknown alias " + addr + ", suspect"})
+			} else {
+				p.add(action{kind: actionBounce, bounce: &Bounce{}, recipients: []string{addr}})
+			}
+			removed = append(removed, addr)
+		default:
+			p.add(action{kind: actionAlias, target: addr})
+		}
+	}
+
+	if len(removed) == 0 {
+		return false, nil
+	}
+	record := p.record
+	record.SES.Receipt.Recipients = removeAddrs(record.SES.Receipt.Recipients, removed)
+	p.record = record
+	return proxyRecipient(record) == "", nil
+}
+
+// execute carries out the actions in the plan in order, stopping at
+// the first error.
+func (p *recordPlan) execute(lgr log15.Logger) error {
+	for _, a := range p.actions {
+		if err := p.run(lgr, a); err != nil {
+			lgr.Error("action_err", "action", a.String(), "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *recordPlan) run(lgr log15.Logger, a action) error {
+	switch a.kind {
+	case actionPolicy:
+		lgr.Info("policy_not_forwarding", "action", a.policy.action)
+		return applyPolicy(a.policy, p.record)
+	case actionErrorEmail:
+		lgr.Info("send_error_email", "reason", a.reason)
+		return sendErrorEmail(a.reason, p.record)
+	case actionQuarantineCommand:
+		return handleQuarantineReply(lgr, p.record, a.target, p.body, p.policy)
+	case actionSNS, actionSQS, actionWebhook, actionLambda:
+		msg, err := p.msg()
+		if err != nil {
+			return err
+		}
+		switch a.kind {
+		case actionSNS:
+			lgr.Info("publish_sns", "sns_topic", a.target)
+			return publishSNS(a.target, msg)
+		case actionSQS:
+			lgr.Info("send_sqs", "sqs_queue", a.target)
+			return sendSQS(a.target, msg)
+		case actionWebhook:
+			lgr.Info("post_webhook", "url", a.target)
+			return postWebhook(a.webhook, msg, p.body)
+		default:
+			lgr.Info("invoke_lambda", "lambda", a.target)
+			return invokeLambda(a.target, msg)
+		}
+	case actionVIPNotify:
+		lgr.Info("vip_notify", "sns_topic", a.target)
+		return notifyVIP(a.target, p.record)
+	case actionExtract:
+		lgr.Info("extract", "codes", len(a.extracted.codes), "links", len(a.extracted.links), "route", a.route)
+		p.extracted.merge(a.extracted)
+		if a.subjectPrefix && p.forward.subjectCode == "" && len(a.extracted.codes) > 0 {
+			p.forward.subjectCode = a.extracted.codes[0]
+		}
+		return nil
+	case actionAttachment:
+		lgr.Info("save_attachment", "key", a.target)
+		saved, err := saveAttachment(a.attachment)
+		if err != nil {
+			return err
+		}
+		p.attachments = append(p.attachments, saved)
+		return nil
+	case actionForward:
+		lgr.Info("forward", "to", a.target)
+		return forwardMessage(p.record, p.body, p.policy, a.target, p.forward)
+	case actionOutbound:
+		return handleOutbound(p.record)
+	case actionReply:
+		return handleReply(lgr, p.record, p.body)
+	case actionGroup:
+		lgr.Info("group_forward", "group", a.target, "members", len(a.members))
+		opts := p.forward
+		opts.group = a.group
+		opts.members = a.members
+		return forwardMessage(p.record, p.body, p.policy, a.target, opts)
+	case actionArchive:
+		lgr.Info("archive", "key", a.target, "route", a.route)
+		return archiveMessage(a.target, a.route, p.policy, p.record)
+	case actionFeed:
+		lgr.Info("feed", "key", a.target, "route", a.route)
+		return publishFeed(lgr, a.feed, a.route, p.record, p.body)
+	case actionDigest:
+		lgr.Info("digest", "schedule", a.target, "route", a.route)
+		return addToDigest(a.target, a.route, p.record, p.body)
+	case actionAutoreply:
+		return sendAutoreply(lgr, a.autoreply, p.record, p.body)
+	case actionAlias:
+		lgr.Info("alias", "alias", a.target, "registered", a.registered != nil)
+		return recordAlias(a.target, p.record)
+	case actionBounce:
+		lgr.Info("bounce", "bounce", a.bounce.String(), "recipients", a.recipients)
+		return bounceMessage(a.bounce, p.record, a.recipients)
+	case actionDiscard:
+		lgr.Info("discard", "reason", a.reason)
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", a.kind)
+}
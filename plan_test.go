@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/inconshreveable/log15"
+)
+
+func TestPlan(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Routes: []Route{
+			{
+				Condition: Condition{Subject: "save off"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:saved",
+				SQS:       []string{"https://sqs.us-east-1.amazonaws.com/123456789012/saved"},
+				Forward:   true,
+			},
+		},
+	}
+
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile("test_data/msg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lgr := log15.New()
+	lgr.SetHandler(log15.DiscardHandler())
+	pl := &planner{
+		lgr: lgr,
+		getMessage: func(string) ([]byte, error) {
+			return raw, nil
+		},
+		released: func(string) bool {
+			return false
+		},
+	}
+
+	record := loadTestEvent(t).Records[0]
+
+	p, err := pl.plan(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"sns publish arn:aws:sns:us-east-1:123456789012:saved",
+		"sqs send https://sqs.us-east-1.amazonaws.com/123456789012/saved",
+		"forward to foo+test@gmail.example.com",
+	}
+	if len(p.actions) != len(expect) {
+		t.Fatalf("got %d actions expected %d: %v", len(p.actions), len(expect), p.actions)
+	}
+	for i, a := range p.actions {
+		if a.String() != expect[i] {
+			t.Errorf("action %d: got %q expected %q", i, a, expect[i])
+		}
+	}
+
+	record.SES.Receipt.VirusVerdict.Status = "FAIL"
+	p, err = pl.plan(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.actions) != 1 || p.actions[0].kind != actionPolicy || p.actions[0].policy.action != policyQuarantine {
+		t.Errorf("expected a single quarantine policy action, got %v", p.actions)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Src: "/.*/"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:saved",
+				Forward:   true,
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	snsPublish = fakeSNSPublish
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+
+	sentEmails = nil
+	snsMessages = nil
+
+	os.Setenv("DRY_RUN", "1")
+	defer os.Unsetenv("DRY_RUN")
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != 0 || len(snsMessages) != 0 {
+		t.Errorf("expected no side effects in dry run, got %d emails and %d sns messages", len(sentEmails), len(snsMessages))
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jhillyerd/enmime"
+)
+
+// Policy actions, in increasing order of severity. When several
+// verdicts fail, the most severe action wins.
+const (
+	// forward the message normally, recording the verdicts in headers
+	policyForward = "forward"
+	// forward the message with the failed verdicts prefixed to the subject
+	policyTag = "tag"
+	// send a notice to the private address instead of the message
+	policyNotify = "notify"
+	// store the message for later release instead of forwarding it
+	policyQuarantine = "quarantine"
+	// silently drop the message
+	policyDrop = "drop"
+	// return an error so the lambda invocation fails
+	policyFail = "fail"
+)
+
+var policySeverity = map[string]int{
+	policyForward:    0,
+	policyTag:        1,
+	policyNotify:     2,
+	policyQuarantine: 3,
+	policyDrop:       4,
+	policyFail:       5,
+}
+
+// Policy maps each SES verdict to the action to take when that
+// verdict does not pass. Unset verdicts fall back to a default.
+type Policy struct {
+	Spam  string `toml:"spam"`
+	Virus string `toml:"virus"`
+	SPF   string `toml:"spf"`
+	DKIM  string `toml:"dkim"`
+	DMARC string `toml:"dmarc"`
+}
+
+func (p *Policy) get(verdict string) string {
+	switch verdict {
+	case "spam":
+		return p.Spam
+	case "virus":
+		return p.Virus
+	case "spf":
+		return p.SPF
+	case "dkim":
+		return p.DKIM
+	case "dmarc":
+		return p.DMARC
+	}
+	return ""
+}
+
+func (p *Policy) validate(name string) error {
+	for _, v := range []string{"spam", "virus", "spf", "dkim", "dmarc"} {
+		action := p.get(v)
+		if _, ok := policySeverity[action]; action != "" && !ok {
+			return fmt.Errorf("%s.%s: unknown action %q", name, v, action)
+		}
+	}
+	return nil
+}
+
+// globalPolicyAction is the action the global policy takes for a
+// failed verdict.
+func globalPolicyAction(verdict string) string {
+	if action := conf.Policy.get(verdict); action != "" {
+		return action
+	}
+	if verdict == "virus" {
+		return policyQuarantine
+	}
+	return policyForward
+}
+
+// policyAction is the action a route takes for a failed verdict.
+// Routes that don't set a policy for dkim, spf or virus quarantine
+// the message unless allow_suspect_messages is set. Anything else
+// falls back to the global policy.
+func (r *Route) policyAction(verdict string) string {
+	if action := r.Policy.get(verdict); action != "" {
+		return action
+	}
+
+	switch verdict {
+	case "dkim", "spf", "virus":
+		if r.AllowSuspectMessages {
+			return policyForward
+		}
+		return policyQuarantine
+	}
+
+	return globalPolicyAction(verdict)
+}
+
+type verdict struct {
+	name   string
+	status string
+	failed bool
+	action string
+}
+
+func (v verdict) String() string {
+	if !v.failed {
+		return v.status
+	}
+	return fmt.Sprintf("%s; action=%s", v.status, v.action)
+}
+
+type policyDecision struct {
+	action   string
+	verdicts []verdict
+}
+
+// decidePolicy applies actionFor to each failed verdict on the
+// receipt and returns the most severe resulting action.
+func decidePolicy(receipt events.SimpleEmailReceipt, actionFor func(verdict string) string) policyDecision {
+	verdicts := []verdict{
+		{name: "spam", status: receipt.SpamVerdict.Status},
+		{name: "virus", status: receipt.VirusVerdict.Status},
+		{name: "spf", status: receipt.SPFVerdict.Status},
+		{name: "dkim", status: receipt.DKIMVerdict.Status},
+		{name: "dmarc", status: receipt.DMARCVerdict.Status},
+	}
+
+	d := policyDecision{
+		action: policyForward,
+	}
+
+	for _, v := range verdicts {
+		// dmarc is only checked when SES reports a verdict for it
+		if v.name == "dmarc" && v.status == "" {
+			continue
+		}
+
+		v.failed = v.status != "PASS"
+		if v.failed {
+			v.action = actionFor(v.name)
+			if policySeverity[v.action] > policySeverity[d.action] {
+				d.action = v.action
+			}
+		}
+		d.verdicts = append(d.verdicts, v)
+	}
+
+	return d
+}
+
+// merge returns d with each verdict's action, and the overall
+// action, raised to o's if o's is more severe. d and o must be
+// decisions for the same receipt.
+func (d policyDecision) merge(o policyDecision) policyDecision {
+	out := policyDecision{
+		action:   d.action,
+		verdicts: make([]verdict, len(d.verdicts)),
+	}
+	if policySeverity[o.action] > policySeverity[out.action] {
+		out.action = o.action
+	}
+	for i, v := range d.verdicts {
+		if i < len(o.verdicts) && policySeverity[o.verdicts[i].action] > policySeverity[v.action] {
+			v.action = o.verdicts[i].action
+		}
+		out.verdicts[i] = v
+	}
+	return out
+}
+
+func (d policyDecision) failed() []string {
+	var names []string
+	for _, v := range d.verdicts {
+		if v.failed {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+// addHeaders records the decision in X-Lambdaemail-* headers.
+func (d policyDecision) addHeaders(b enmime.MailBuilder) enmime.MailBuilder {
+	for _, v := range d.verdicts {
+		b = b.Header("X-Lambdaemail-"+strings.Title(v.name)+"-Verdict", v.String())
+	}
+	return b.Header("X-Lambdaemail-Policy", d.action)
+}
+
+// subject returns the forwarded subject, tagged with the failed
+// verdicts if the decision calls for it.
+func (d policyDecision) subject(subject string) string {
+	if d.action != policyTag {
+		return subject
+	}
+	return "[" + strings.Join(d.failed(), ",") + "] " + subject
+}
+
+// applyPolicy carries out a decision that stops the message from
+// being processed normally.
+func applyPolicy(d policyDecision, record events.SimpleEmailRecord) error {
+	reasons := strings.Join(d.failed(), ",")
+
+	switch d.action {
+	case policyDrop:
+		return nil
+	case policyNotify:
+		return sendNotice(conf.destination(proxyRecipient(record)), fmt.Sprintf("Message failed %s checks, not forwarding", reasons), record)
+	case policyQuarantine:
+		return quarantineMessage(d, record)
+	case policyFail:
+		return fmt.Errorf("message %s failed %s checks", record.SES.Mail.MessageID, reasons)
+	}
+
+	return fmt.Errorf("unexpected policy action %q", d.action)
+}
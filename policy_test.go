@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestDecidePolicy(t *testing.T) {
+	conf = &Config{
+		Policy: Policy{
+			Spam: policyTag,
+		},
+	}
+
+	receipt := func(spam, virus, spf, dkim, dmarc string) events.SimpleEmailReceipt {
+		return events.SimpleEmailReceipt{
+			SpamVerdict:  events.SimpleEmailVerdict{Status: spam},
+			VirusVerdict: events.SimpleEmailVerdict{Status: virus},
+			SPFVerdict:   events.SimpleEmailVerdict{Status: spf},
+			DKIMVerdict:  events.SimpleEmailVerdict{Status: dkim},
+			DMARCVerdict: events.SimpleEmailVerdict{Status: dmarc},
+		}
+	}
+
+	strictRoute := Route{
+		Policy: Policy{
+			Spam:  policyDrop,
+			DMARC: policyQuarantine,
+		},
+	}
+	suspectRoute := Route{
+		AllowSuspectMessages: true,
+	}
+
+	checks := []struct {
+		name     string
+		receipt  events.SimpleEmailReceipt
+		actionFn func(string) string
+		action   string
+		failed   []string
+	}{
+		{"global_pass", receipt("PASS", "PASS", "PASS", "PASS", ""), globalPolicyAction, policyForward, nil},
+		{"global_spam_tag", receipt("FAIL", "PASS", "PASS", "PASS", ""), globalPolicyAction, policyTag, []string{"spam"}},
+		{"global_virus_quarantine", receipt("FAIL", "FAIL", "PASS", "PASS", ""), globalPolicyAction, policyQuarantine, []string{"spam", "virus"}},
+		{"global_dkim_default", receipt("PASS", "PASS", "PASS", "FAIL", "FAIL"), globalPolicyAction, policyForward, []string{"dkim", "dmarc"}},
+		{"route_legacy_suspect", receipt("PASS", "PASS", "GRAY", "PASS", ""), (&Route{}).policyAction, policyQuarantine, []string{"spf"}},
+		{"route_allow_suspect", receipt("PASS", "PASS", "GRAY", "FAIL", ""), suspectRoute.policyAction, policyForward, []string{"spf", "dkim"}},
+		{"route_allow_suspect_global_spam", receipt("FAIL", "PASS", "PASS", "PASS", ""), suspectRoute.policyAction, policyTag, []string{"spam"}},
+		{"route_override", receipt("FAIL", "PASS", "PASS", "PASS", "FAIL"), strictRoute.policyAction, policyDrop, []string{"spam", "dmarc"}},
+		{"route_override_dmarc", receipt("PASS", "PASS", "PASS", "PASS", "FAIL"), strictRoute.policyAction, policyQuarantine, []string{"dmarc"}},
+	}
+
+	for _, c := range checks {
+		d := decidePolicy(c.receipt, c.actionFn)
+		if d.action != c.action {
+			t.Errorf("%s: got action %s expected %s", c.name, d.action, c.action)
+		}
+		if !reflect.DeepEqual(d.failed(), c.failed) {
+			t.Errorf("%s: got failed %v expected %v", c.name, d.failed(), c.failed)
+		}
+	}
+}
+
+func TestPolicyHeaders(t *testing.T) {
+	conf = &Config{
+		Policy: Policy{
+			Spam: policyTag,
+		},
+	}
+
+	d := decidePolicy(events.SimpleEmailReceipt{
+		SpamVerdict:  events.SimpleEmailVerdict{Status: "FAIL"},
+		VirusVerdict: events.SimpleEmailVerdict{Status: "PASS"},
+		SPFVerdict:   events.SimpleEmailVerdict{Status: "PASS"},
+		DKIMVerdict:  events.SimpleEmailVerdict{Status: "GRAY"},
+	}, globalPolicyAction)
+
+	if got, expect := d.subject("hello"), "[spam,dkim] hello"; got != expect {
+		t.Errorf("subject got %q expected %q", got, expect)
+	}
+
+	b := enmime.Builder().From("", "a@example.com").To("", "b@example.com").Subject("hello").Text([]byte("hi"))
+	b = d.addHeaders(b)
+	root, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		header string
+		expect string
+	}{
+		{"X-Lambdaemail-Spam-Verdict", "FAIL; action=tag"},
+		{"X-Lambdaemail-Virus-Verdict", "PASS"},
+		{"X-Lambdaemail-Dkim-Verdict", "GRAY; action=forward"},
+		{"X-Lambdaemail-Dmarc-Verdict", ""},
+		{"X-Lambdaemail-Policy", "tag"},
+	}
+	for _, c := range checks {
+		if got := root.Header.Get(c.header); got != c.expect {
+			t.Errorf("%s: got %q expected %q", c.header, got, c.expect)
+		}
+	}
+
+	var p Policy
+	p.Virus = "explode"
+	if err := p.validate("policy"); err == nil {
+		t.Errorf("expected unknown action to fail validation")
+	}
+}
+
+// TestRoutePolicyTag checks that a matched route's tag policy tags
+// the forwarded message when the global policy would forward it as
+// is.
+func TestRoutePolicyTag(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Src: "/.*/", Dst: "/.*/"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:tagged",
+				Forward:   true,
+				Policy:    Policy{Spam: policyTag},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3GetObjReq = fakeGetObjReq
+	snsPublish = fakeSNSPublish
+	defer func() {
+		sentEmails = nil
+		snsMessages = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	sse.Records[0].SES.Receipt.SpamVerdict.Status = "FAIL"
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+
+	sentEmails = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[0].input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		header string
+		expect string
+	}{
+		{"Subject", "[spam] save off header"},
+		{"X-Lambdaemail-Spam-Verdict", "FAIL; action=tag"},
+		{"X-Lambdaemail-Policy", "tag"},
+	}
+	for _, c := range checks {
+		if got := env.GetHeader(c.header); got != c.expect {
+			t.Errorf("%s: got %q expected %q", c.header, got, c.expect)
+		}
+	}
+}
+
+// TestRoutePolicyDrop checks that a matching route whose policy drops
+// a suspect message discards it instead of forwarding it.
+func TestRoutePolicyDrop(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+		},
+		Routes: []Route{
+			{
+				Condition: Condition{Src: "/.*/", Dst: "/.*/"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:dropped",
+				Forward:   true,
+				Policy:    Policy{Spam: policyDrop},
+			},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3GetObjReq = fakeGetObjReq
+	snsPublish = fakeSNSPublish
+	defer func() {
+		sentEmails = nil
+		snsMessages = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	sse := loadTestEvent(t)
+	sse.Records[0].SES.Receipt.SpamVerdict.Status = "FAIL"
+	putTestMessage(t, sse.Records[0].SES.Mail.MessageID, "test_data/msg0")
+
+	sentEmails = nil
+	snsMessages = nil
+
+	if err := Handler(sse); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 0 {
+		t.Errorf("expected dropped message not to be forwarded got %d emails", len(sentEmails))
+	}
+	if len(snsMessages) != 0 {
+		t.Errorf("expected dropped message not to be published got %d", len(snsMessages))
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/quarantine"
+)
+
+var quarantineSubjectRe = regexp.MustCompile(`(?i)quarantined message ([a-z0-9]+)`)
+
+func quarantineKey(id string) string {
+	return path.Join(conf.QuarantinePrefix(), id)
+}
+
+func quarantineInfoKey(id string) string {
+	return path.Join(conf.QuarantinePrefix(), id+".json")
+}
+
+func quarantineAddress() string {
+	return "quarantine@" + conf.Domain
+}
+
+// quarantineMessage copies the message into the quarantine prefix,
+// writes its metadata sidecar and notifies the private address.
+func quarantineMessage(d policyDecision, record events.SimpleEmailRecord) error {
+	var (
+		mail = record.SES.Mail
+		id   = mail.MessageID
+	)
+
+	src := path.Join(conf.Bucket.Name, conf.Bucket.MsgPrefix, id)
+	dst := quarantineKey(id)
+	_, err := s3CopyObj(&s3.CopyObjectInput{
+		Bucket:     &conf.Bucket.Name,
+		CopySource: &src,
+		Key:        &dst,
+	})
+	if err != nil {
+		return fmt.Errorf("copy %s to quarantine err: %w", id, err)
+	}
+
+	info := quarantine.Info{
+		ID:            id,
+		From:          mail.CommonHeaders.From,
+		To:            mail.CommonHeaders.To,
+		Subject:       mail.CommonHeaders.Subject,
+		Date:          mail.CommonHeaders.Date,
+		Status:        quarantine.StatusQuarantined,
+		QuarantinedAt: time.Now(),
+		Record:        record,
+	}
+	for _, v := range d.verdicts {
+		if v.failed {
+			info.Reasons = append(info.Reasons, v.name+"="+v.status)
+		}
+	}
+
+	if err := putQuarantineInfo(info); err != nil {
+		return err
+	}
+
+	return sendQuarantineNotice(info)
+}
+
+func getQuarantineInfo(id string) (quarantine.Info, error) {
+	var info quarantine.Info
+
+	p := quarantineInfoKey(id)
+	obj, err := s3GetObj(&s3.GetObjectInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &p,
+	})
+	if err != nil {
+		return info, err
+	}
+	defer obj.Body.Close()
+
+	err = json.NewDecoder(obj.Body).Decode(&info)
+	return info, err
+}
+
+func putQuarantineInfo(info quarantine.Info) error {
+	p := quarantineInfoKey(info.ID)
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	_, err = s3PutObj(&s3manager.UploadInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &p,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// quarantineReleased reports whether the message was quarantined
+// and has since been released.
+func quarantineReleased(lgr log15.Logger, id string) bool {
+	info, err := getQuarantineInfo(id)
+	if err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != s3.ErrCodeNoSuchKey {
+			lgr.Error("get_quarantine_info_err", "err", err)
+		}
+		return false
+	}
+	return info.Status == quarantine.StatusReleased
+}
+
+// sendQuarantineNotice sends the notice to the address the message
+// would have been forwarded to.
+func sendQuarantineNotice(info quarantine.Info) error {
+	fromAddr := quarantineAddress()
+	toAddr := conf.destination(proxyRecipient(info.Record))
+
+	b := enmime.Builder()
+	b = b.From("Lambda Email Quarantine", fromAddr)
+	b = b.To("", toAddr)
+	b = b.Subject(fmt.Sprintf("Quarantined message %s: %s", info.ID, info.Subject))
+
+	body := fmt.Sprintf(`A message was quarantined.
+
+From:    %s
+To:      %s
+Subject: %s
+Date:    %s
+Reasons: %s
+
+Reply to this message with RELEASE on the first line to forward it,
+or PURGE to delete it.
+`, strings.Join(info.From, ", "), strings.Join(info.To, ", "), info.Subject, info.Date, strings.Join(info.Reasons, ", "))
+	b = b.Text([]byte(body))
+	b = b.Header("X-Lambdaemail-Quarantine-Id", info.ID)
+
+	root, err := b.Build()
+	if err != nil {
+		return fmt.Errorf("Build quarantine notice err=%q", err)
+	}
+
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		return fmt.Errorf("Encode quarantine notice err=%q", err)
+	}
+
+	_, err = sendEmail(&ses.SendRawEmailInput{
+		Destinations: strList([]string{toAddr}),
+		RawMessage: &ses.RawMessage{
+			Data: buf.Bytes(),
+		},
+		Source: &fromAddr,
+	})
+	if err != nil {
+		return fmt.Errorf("send quarantine notice error: %s", err)
+	}
+
+	return nil
+}
+
+// handleQuarantineReply processes a RELEASE or PURGE reply to a
+// quarantine notice from fromAddr. Commands are accepted from the
+// private address, or from the address the notice was sent to.
+func handleQuarantineReply(lgr log15.Logger, record events.SimpleEmailRecord, fromAddr string, body *enmime.Envelope, policy policyDecision) error {
+	if failed := policy.failed(); len(failed) > 0 {
+		return fmt.Errorf("refusing quarantine command from message failing %v", failed)
+	}
+
+	m := quarantineSubjectRe.FindStringSubmatch(record.SES.Mail.CommonHeaders.Subject)
+	if m == nil {
+		return fmt.Errorf("no quarantine id found in subject %q", record.SES.Mail.CommonHeaders.Subject)
+	}
+	id := m[1]
+
+	info, err := getQuarantineInfo(id)
+	if err != nil {
+		return fmt.Errorf("get quarantine info %s err: %w", id, err)
+	}
+	if !strings.EqualFold(fromAddr, conf.PrivateAccountAddress) && !strings.EqualFold(fromAddr, conf.destination(proxyRecipient(info.Record))) {
+		return fmt.Errorf("refusing quarantine command for %s from %s", id, fromAddr)
+	}
+
+	var command string
+	for _, line := range strings.Split(body.Text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			command = strings.ToLower(strings.Fields(line)[0])
+			break
+		}
+	}
+
+	lgr = lgr.New("quarantine_id", id, "command", command)
+
+	switch command {
+	case "release":
+		info, err := releaseQuarantine(id)
+		if err != nil {
+			return err
+		}
+		lgr.Info("quarantine_released")
+		// the message was already checked against the quota when it
+		// was received, so it isn't counted again
+		return handleRecord(lgr.New("released_msg_id", info.Record.SES.Mail.MessageID), info.Record, false)
+	case "purge":
+		if err := purgeQuarantine(id); err != nil {
+			return err
+		}
+		lgr.Info("quarantine_purged")
+		return nil
+	}
+
+	return fmt.Errorf("unknown quarantine command %q", command)
+}
+
+func releaseQuarantine(id string) (quarantine.Info, error) {
+	info, err := getQuarantineInfo(id)
+	if err != nil {
+		return info, fmt.Errorf("get quarantine info %s err: %w", id, err)
+	}
+
+	now := time.Now()
+	info.Status = quarantine.StatusReleased
+	info.ReleasedAt = &now
+
+	return info, putQuarantineInfo(info)
+}
+
+func purgeQuarantine(id string) error {
+	keys := []string{
+		path.Join(conf.Bucket.MsgPrefix, id),
+		quarantineKey(id),
+		quarantineInfoKey(id),
+	}
+
+	for _, key := range keys {
+		key := key
+		_, err := s3DeleteObj(&s3.DeleteObjectInput{
+			Bucket: &conf.Bucket.Name,
+			Key:    &key,
+		})
+		if err != nil {
+			return fmt.Errorf("delete %s err: %w", key, err)
+		}
+	}
+
+	return nil
+}
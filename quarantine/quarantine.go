@@ -0,0 +1,26 @@
+package quarantine
+
+import (
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	StatusQuarantined = "quarantined"
+	StatusReleased    = "released"
+)
+
+// Info is the metadata sidecar stored next to a quarantined message.
+type Info struct {
+	ID            string                   `json:"id"`
+	From          []string                 `json:"from"`
+	To            []string                 `json:"to"`
+	Subject       string                   `json:"subject"`
+	Date          string                   `json:"date"`
+	Reasons       []string                 `json:"reasons"`
+	Status        string                   `json:"status"`
+	QuarantinedAt time.Time                `json:"quarantined_at"`
+	ReleasedAt    *time.Time               `json:"released_at,omitempty"`
+	Record        events.SimpleEmailRecord `json:"record"`
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/quarantine"
+)
+
+func TestQuarantine(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			QuarantinePrefix:  "/quarantine",
+		},
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3CopyObj = fakeCopyObj
+	s3DeleteObj = fakeDeleteObj
+	s3GetObjReq = fakeGetObjReq
+	snsPublish = fakeSNSPublish
+
+	sse := loadTestEvent(t)
+	record := sse.Records[0]
+	id := record.SES.Mail.MessageID
+	record.SES.Receipt.VirusVerdict.Status = "FAIL"
+	sse.Records[0] = record
+
+	putTestMessage(t, id, "test_data/msg0")
+
+	sentBefore := len(sentEmails)
+	err := Handler(sse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fakeS3[bucketKey{conf.Bucket.Name, "/quarantine/" + id}]; !ok {
+		t.Fatalf("expected message to be copied to quarantine")
+	}
+
+	info, err := getQuarantineInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != quarantine.StatusQuarantined || info.Reasons[0] != "virus=FAIL" {
+		t.Fatalf("unexpected quarantine info: %+v", info)
+	}
+
+	if len(sentEmails) != sentBefore+1 {
+		t.Fatalf("expected 1 quarantine notice but got %d emails", len(sentEmails)-sentBefore)
+	}
+	notice, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[len(sentEmails)-1].input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := notice.GetHeader("X-Lambdaemail-Quarantine-Id"); got != id {
+		t.Fatalf("notice quarantine id got %q expected %q", got, id)
+	}
+
+	// reply to the notice with RELEASE
+	replyID := "reply-" + id
+	reply := "From: foo@gmail.example.com\r\n" +
+		"To: quarantine@my-ses-email-domain.example.com\r\n" +
+		"Subject: Re: " + notice.GetHeader("Subject") + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"release\r\n" +
+		"\r\n" +
+		"> A message was quarantined.\r\n"
+	putTestMessageBytes(t, replyID, []byte(reply))
+
+	replyRecord := sse.Records[0]
+	replyRecord.SES.Receipt.VirusVerdict.Status = "PASS"
+	replyRecord.SES.Mail.MessageID = replyID
+	replyRecord.SES.Mail.CommonHeaders.From = []string{"foo@gmail.example.com"}
+	replyRecord.SES.Mail.CommonHeaders.To = []string{"quarantine@my-ses-email-domain.example.com"}
+	replyRecord.SES.Mail.CommonHeaders.Subject = "Re: " + notice.GetHeader("Subject")
+	replyRecord.SES.Receipt.Recipients = []string{"quarantine@my-ses-email-domain.example.com"}
+
+	sentBefore = len(sentEmails)
+	err = Handler(events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{replyRecord}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sentEmails) != sentBefore+1 {
+		t.Fatalf("expected released message to be forwarded, got %d emails", len(sentEmails)-sentBefore)
+	}
+	fwd, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[len(sentEmails)-1].input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fwd.GetHeader("X-Lambdaemail-Id"); got != id {
+		t.Fatalf("forwarded message id got %q expected %q", got, id)
+	}
+	if got := fwd.GetHeader("X-Lambdaemail-Virus-Verdict"); !strings.HasPrefix(got, "FAIL") {
+		t.Fatalf("forwarded virus verdict got %q", got)
+	}
+
+	info, err = getQuarantineInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != quarantine.StatusReleased {
+		t.Fatalf("expected quarantine status released, got %s", info.Status)
+	}
+
+	if err := purgeQuarantine(id); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/periphery-corollas/" + id, "/quarantine/" + id, "/quarantine/" + id + ".json"} {
+		if _, ok := fakeS3[bucketKey{conf.Bucket.Name, key}]; ok {
+			t.Errorf("expected %s to be purged", key)
+		}
+	}
+}
+
+// TestQuarantineDestination checks that quarantine and notify
+// notices go to the alias's destination, and that only the
+// destination or the private address can release the message.
+func TestQuarantineDestination(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			QuarantinePrefix:  "/quarantine-destination",
+		},
+		Policy: Policy{Spam: policyNotify},
+		Destinations: []Destination{
+			{Aliases: []string{"test"}, Address: "alice@mail.example.net"},
+			{Aliases: []string{"bob"}, Address: "bob@mail.example.org"},
+		},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3CopyObj = fakeCopyObj
+	s3GetObjReq = fakeGetObjReq
+	defer func() {
+		sentEmails = nil
+	}()
+
+	sse := loadTestEvent(t)
+	record := sse.Records[0]
+	id := record.SES.Mail.MessageID
+	putTestMessage(t, id, "test_data/msg0")
+
+	for _, verdict := range []string{"spam", "virus"} {
+		r := record
+		if verdict == "spam" {
+			r.SES.Receipt.SpamVerdict.Status = "FAIL"
+		} else {
+			r.SES.Receipt.VirusVerdict.Status = "FAIL"
+		}
+
+		sentEmails = nil
+		if err := Handler(events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{r}}); err != nil {
+			t.Fatal(err)
+		}
+		if len(sentEmails) != 1 {
+			t.Fatalf("%s: expected 1 notice got %d emails", verdict, len(sentEmails))
+		}
+		if got := *sentEmails[0].input.Destinations[0]; got != "alice@mail.example.net" {
+			t.Errorf("%s: notice sent to %s", verdict, got)
+		}
+	}
+
+	notice, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[0].input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := func(from string) events.SimpleEmailRecord {
+		replyID := "reply-" + from
+		putTestMessageBytes(t, replyID, []byte("From: "+from+"\r\n"+
+			"To: quarantine@my-ses-email-domain.example.com\r\n"+
+			"Subject: Re: "+notice.GetHeader("Subject")+"\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"release\r\n"))
+
+		r := record
+		r.SES.Mail.MessageID = replyID
+		r.SES.Mail.CommonHeaders.From = []string{from}
+		r.SES.Mail.CommonHeaders.To = []string{"quarantine@my-ses-email-domain.example.com"}
+		r.SES.Mail.CommonHeaders.Subject = "Re: " + notice.GetHeader("Subject")
+		r.SES.Receipt.Recipients = []string{"quarantine@my-ses-email-domain.example.com"}
+		return r
+	}
+
+	err = Handler(events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{reply("bob@mail.example.org")}})
+	if err == nil {
+		t.Fatalf("expected release from another destination to fail")
+	}
+
+	sentEmails = nil
+	if err := Handler(events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{reply("alice@mail.example.net")}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 1 || *sentEmails[0].input.Destinations[0] != "alice+test@mail.example.net" {
+		t.Fatalf("expected released message to be forwarded to alice, got %d emails", len(sentEmails))
+	}
+}
+
+// TestQuarantineReleaseQuota checks that releasing a quarantined
+// message forwards it even when the quota for the day it was received
+// is used up.
+func TestQuarantineReleaseQuota(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			QuarantinePrefix:  "/quarantine-quota",
+			QuotaPrefix:       "/quota-release",
+		},
+		Policy: Policy{Spam: policyQuarantine},
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3CopyObj = fakeCopyObj
+	s3GetObjReq = fakeGetObjReq
+	s3ListObjs = fakeListObjs
+	defer func() {
+		sentEmails = nil
+	}()
+
+	sse := loadTestEvent(t)
+	record := sse.Records[0]
+	record.SES.Mail.MessageID = "quotaquarantined"
+	record.SES.Receipt.SpamVerdict.Status = "FAIL"
+	putTestMessage(t, record.SES.Mail.MessageID, "test_data/msg0")
+
+	sentEmails = nil
+	if err := Handler(events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{record}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 quarantine notice got %d emails", len(sentEmails))
+	}
+	notice, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[0].input.RawMessage.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the quota for the day the message was received is used up
+	conf.Quota.DailyMessages = 1
+	day := record.SES.Mail.Timestamp.UTC().Format("2006-01-02")
+	fakeS3[bucketKey{conf.Bucket.Name, "/quota-release/" + day + "/other-msg"}] = nil
+
+	putTestMessageBytes(t, "quota-reply", []byte("From: foo@gmail.example.com\r\n"+
+		"To: quarantine@my-ses-email-domain.example.com\r\n"+
+		"Subject: Re: "+notice.GetHeader("Subject")+"\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"release\r\n"))
+	reply := sse.Records[0]
+	reply.SES.Mail.MessageID = "quota-reply"
+	reply.SES.Mail.Timestamp = record.SES.Mail.Timestamp.Add(24 * time.Hour)
+	reply.SES.Mail.CommonHeaders.From = []string{"foo@gmail.example.com"}
+	reply.SES.Mail.CommonHeaders.To = []string{"quarantine@my-ses-email-domain.example.com"}
+	reply.SES.Mail.CommonHeaders.Subject = "Re: " + notice.GetHeader("Subject")
+	reply.SES.Receipt.Recipients = []string{"quarantine@my-ses-email-domain.example.com"}
+
+	sentEmails = nil
+	if err := Handler(events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{reply}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentEmails) != 1 || *sentEmails[0].input.Destinations[0] != "foo+test@gmail.example.com" {
+		t.Fatalf("expected released message to be forwarded, got %d emails", len(sentEmails))
+	}
+}
+
+func loadTestEvent(t *testing.T) events.SimpleEmailEvent {
+	t.Helper()
+
+	f, err := os.Open("test_data/sse-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var sse events.SimpleEmailEvent
+	if err := json.NewDecoder(f).Decode(&sse); err != nil {
+		t.Fatal(err)
+	}
+	return sse
+}
+
+func putTestMessage(t *testing.T, id, file string) {
+	t.Helper()
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestMessageBytes(t, id, b)
+}
+
+func putTestMessageBytes(t *testing.T, id string, b []byte) {
+	t.Helper()
+
+	key := fmt.Sprintf("%s/%s", conf.Bucket.MsgPrefix, id)
+	fakeS3[bucketKey{conf.Bucket.Name, key}] = b
+}
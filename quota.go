@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const defaultQuotaPrefix = "/quota"
+
+// Quota limits how many messages are processed each day (UTC).
+// Messages over the quota are left in the message bucket without
+// being routed or forwarded.
+type Quota struct {
+	DailyMessages int `toml:"daily_messages"`
+}
+
+func (q *Quota) validate() error {
+	if q.DailyMessages < 0 {
+		return errors.New("quota.daily_messages must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) QuotaPrefix() string {
+	if c.Bucket.QuotaPrefix == "" {
+		return defaultQuotaPrefix
+	}
+	return c.Bucket.QuotaPrefix
+}
+
+// useQuota reports whether mail is within the daily quota. Each
+// message counted is stored as an empty object under the day's
+// prefix, so a retried message is only counted once. Concurrent
+// invocations may let a few messages past the quota. If record is
+// false mail is checked but not counted.
+func useQuota(mail events.SimpleEmailMessage, record bool) (bool, error) {
+	if conf.Quota.DailyMessages == 0 {
+		return true, nil
+	}
+
+	day := path.Join(conf.QuotaPrefix(), mail.Timestamp.UTC().Format("2006-01-02")) + "/"
+	key := day + mail.MessageID
+
+	keys, err := listKeys(day)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if k == key {
+			return true, nil
+		}
+	}
+	if len(keys) >= conf.Quota.DailyMessages {
+		return false, nil
+	}
+
+	if record {
+		_, err = s3PutObj(&s3manager.UploadInput{
+			Bucket: &conf.Bucket.Name,
+			Key:    &key,
+			Body:   bytes.NewReader(nil),
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
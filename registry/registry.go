@@ -0,0 +1,18 @@
+package registry
+
+import "time"
+
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// Alias is the registry entry stored for each alias address.
+type Alias struct {
+	Alias       string     `json:"alias"`
+	Status      string     `json:"status"`
+	Note        string     `json:"note,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FirstSender string     `json:"first_sender,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
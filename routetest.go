@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gomail "net/mail"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/lambda-email/registry"
+)
+
+// routeTestCommand runs the routing decisions in Handler against a
+// local message without calling AWS and prints the result.
+func routeTestCommand(args []string) error {
+	fs := flag.NewFlagSet("route-test", flag.ContinueOnError)
+	msgPath := fs.String("msg", "", "Raw message to use with an SES event file (for body and header conditions)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s route-test [-msg message.eml] <message.eml|ses-event.json>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a single message or event file")
+	}
+
+	conf = loadLocalConfig()
+	if conf.Sieve.S3Key == "" {
+		if err := conf.loadSieve(); err != nil {
+			return err
+		}
+	}
+	// messages to a tenant's domain are planned with its config, as
+	// in Handler. Tenant configs and sieve scripts may be in s3.
+	if conf.Tenants.Dir != "" || conf.Tenants.S3Prefix != "" {
+		initAWS()
+	}
+	if err := conf.loadTenants(); err != nil {
+		return err
+	}
+
+	input, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var raw []byte
+	if *msgPath != "" {
+		raw, err = ioutil.ReadFile(*msgPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	records, err := routeTestRecords(input, raw)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if err := printRoutePlan(os.Stdout, r.record, r.raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type routeTestRecord struct {
+	record events.SimpleEmailRecord
+	raw    []byte
+}
+
+// routeTestRecords reads input as either an SES event or a raw
+// message. SES events don't include the message body, so raw is
+// used for the body if set, otherwise a message is built from the
+// headers in the event.
+func routeTestRecords(input, raw []byte) ([]routeTestRecord, error) {
+	var sse events.SimpleEmailEvent
+	if err := json.Unmarshal(input, &sse); err == nil && len(sse.Records) > 0 {
+		records := make([]routeTestRecord, 0, len(sse.Records))
+		for _, record := range sse.Records {
+			msg := raw
+			if msg == nil {
+				var buf bytes.Buffer
+				for _, h := range record.SES.Mail.Headers {
+					fmt.Fprintf(&buf, "%s: %s\r\n", h.Name, h.Value)
+				}
+				buf.WriteString("\r\n")
+				msg = buf.Bytes()
+			}
+			records = append(records, routeTestRecord{record: record, raw: msg})
+		}
+		return records, nil
+	}
+
+	record, err := recordFromMessage(input)
+	if err != nil {
+		return nil, err
+	}
+	return []routeTestRecord{{record: record, raw: input}}, nil
+}
+
+// recordFromMessage builds an SES record for a raw message as if
+// it had been delivered to every recipient on our or our tenants'
+// domains. Spam and
+// virus verdicts are taken from the X-SES-* headers if present;
+// everything else passes.
+func recordFromMessage(raw []byte) (events.SimpleEmailRecord, error) {
+	var record events.SimpleEmailRecord
+
+	msg, err := gomail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return record, fmt.Errorf("parse message err: %w", err)
+	}
+
+	mail := &record.SES.Mail
+	mail.MessageID = "route-test"
+	mail.CommonHeaders.Subject = msg.Header.Get("Subject")
+	mail.CommonHeaders.Date = msg.Header.Get("Date")
+	mail.CommonHeaders.MessageID = msg.Header.Get("Message-Id")
+	if from := msg.Header.Get("From"); from != "" {
+		mail.CommonHeaders.From = []string{from}
+	}
+
+	for _, name := range []string{"To", "Cc"} {
+		addrs, err := msg.Header.AddressList(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if name == "To" {
+				mail.CommonHeaders.To = append(mail.CommonHeaders.To, addr.String())
+			}
+			mail.Destination = append(mail.Destination, addr.Address)
+			if conf.forDomain(domainOf(addr.Address)) != nil {
+				record.SES.Receipt.Recipients = append(record.SES.Receipt.Recipients, addr.Address)
+			}
+		}
+	}
+
+	for name, values := range msg.Header {
+		for _, v := range values {
+			mail.Headers = append(mail.Headers, events.SimpleEmailHeader{Name: name, Value: v})
+		}
+	}
+
+	verdict := func(header string) events.SimpleEmailVerdict {
+		if v := msg.Header.Get(header); v != "" {
+			return events.SimpleEmailVerdict{Status: v}
+		}
+		return events.SimpleEmailVerdict{Status: "PASS"}
+	}
+	receipt := &record.SES.Receipt
+	receipt.SpamVerdict = verdict("X-SES-Spam-Verdict")
+	receipt.VirusVerdict = verdict("X-SES-Virus-Verdict")
+	receipt.SPFVerdict = events.SimpleEmailVerdict{Status: "PASS"}
+	receipt.DKIMVerdict = events.SimpleEmailVerdict{Status: "PASS"}
+
+	return record, nil
+}
+
+// printRoutePlan prints the plan Handler would carry out for
+// record. Quarantined messages are assumed not to have been released.
+func printRoutePlan(w io.Writer, record events.SimpleEmailRecord, raw []byte) error {
+	mail := record.SES.Mail
+
+	lgr := log15.New("msg_id", mail.MessageID)
+	lgr.SetHandler(log15.DiscardHandler())
+
+	root := conf
+	conf = root.forRecord(record)
+	defer func() {
+		conf = root
+	}()
+
+	pl := &planner{
+		lgr: lgr,
+		getMessage: func(string) ([]byte, error) {
+			return raw, nil
+		},
+		released: func(string) bool {
+			return false
+		},
+		// only config members are known locally, and no message is
+		// known to be one of our forwards or alias to be registered
+		members: configMembers,
+		forwarded: func(string) bool {
+			return false
+		},
+		alias: func(string) (*registry.Alias, error) {
+			return nil, nil
+		},
+	}
+
+	fmt.Fprintf(w, "message %s\n", mail.MessageID)
+	fmt.Fprintf(w, "  from:    %s\n", strings.Join(mail.CommonHeaders.From, ", "))
+	fmt.Fprintf(w, "  to:      %s\n", strings.Join(mail.CommonHeaders.To, ", "))
+	fmt.Fprintf(w, "  subject: %s\n", mail.CommonHeaders.Subject)
+	if conf.Sieve.S3Key != "" {
+		fmt.Fprintf(w, "  sieve script %s not evaluated (stored in s3)\n", conf.Sieve.S3Key)
+	}
+
+	p, err := pl.plan(record)
+	if err != nil {
+		fmt.Fprintf(w, "  => error: %s\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(w, "  policy:  %s (failed: %s)\n", p.policy.action, strings.Join(p.policy.failed(), ","))
+	for _, a := range p.actions {
+		fmt.Fprintf(w, "  => %s\n", a)
+	}
+
+	return nil
+}
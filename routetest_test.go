@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRouteTest(t *testing.T) {
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		Routes: []Route{
+			{
+				Condition: Condition{Subject: "save off"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:saved",
+				Stop:      true,
+			},
+			{
+				Condition: Condition{Src: "/.*/"},
+				SNS:       "arn:aws:sns:us-east-1:123456789012:catch_all",
+			},
+		},
+	}
+
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := os.ReadFile("test_data/sse-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := os.ReadFile("test_data/msg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name   string
+		input  []byte
+		expect []string
+	}{
+		{
+			name:   "eml",
+			input:  msg,
+			expect: []string{"=> sns publish arn:aws:sns:us-east-1:123456789012:saved", "=> discard (skip forwarding)"},
+		},
+		{
+			name:   "event",
+			input:  event,
+			expect: []string{"message 8ffg1s10miueo0o4qhb37ss9ilq26akqpo7pr8o1", "=> sns publish arn:aws:sns:us-east-1:123456789012:saved", "=> discard (skip forwarding)"},
+		},
+	}
+
+	for _, c := range checks {
+		records, err := routeTestRecords(c.input, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("%s: expected 1 record got %d", c.name, len(records))
+		}
+
+		var buf bytes.Buffer
+		if err := printRoutePlan(&buf, records[0].record, records[0].raw); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		out := buf.String()
+		for _, e := range c.expect {
+			if !strings.Contains(out, e) {
+				t.Errorf("%s: expected %q in output:\n%s", c.name, e, out)
+			}
+		}
+		if strings.Contains(out, "catch_all") {
+			t.Errorf("%s: catch_all route should not run after stop:\n%s", c.name, out)
+		}
+	}
+
+	conf.Routes[0].Forward = true
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := routeTestRecords(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printRoutePlan(&buf, records[0].record, records[0].raw); err != nil {
+		t.Fatal(err)
+	}
+	if expect := "=> forward to foo+test@gmail.example.com"; !strings.Contains(buf.String(), expect) {
+		t.Errorf("expected %q in output:\n%s", expect, buf.String())
+	}
+}
+
+func TestRouteTestTenant(t *testing.T) {
+	dir := t.TempDir()
+	tenantConfig := testTenantConfig + `
+[[route]]
+subject = "save off"
+sns     = "arn:aws:sns:us-east-1:123456789012:tenant_saved"
+forward = true
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "tenant.example.org.toml"), []byte(tenantConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		OutboundAddress:       "outbound@my-ses-email-domain.example.com",
+		AwsRegion:             "us-east-1",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			OutboxPrefix:      "/outbox",
+		},
+		Tenants: Tenants{Dir: dir},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.loadTenants(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("From: Peter Sanford <psanford@example.com>\r\n" +
+		"To: shop@tenant.example.org\r\n" +
+		"Subject: save off header\r\n" +
+		"\r\n" +
+		"hi\r\n")
+
+	records, err := routeTestRecords(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printRoutePlan(&buf, records[0].record, records[0].raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"=> sns publish arn:aws:sns:us-east-1:123456789012:tenant_saved",
+		"=> forward to owner+shop@mail.example.net",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in output:\n%s", expect, buf.String())
+		}
+	}
+}
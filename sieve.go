@@ -0,0 +1,1057 @@
+package main
+
+import (
+	"fmt"
+	gomail "net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of Sieve (RFC 5228) that lambda-email
+// supports as an alternative to [[route]] entries.
+//
+// Supported commands: require, if/elsif/else, stop, keep, discard,
+// fileinto, redirect and notify (RFC 5435).
+// Supported tests: address, header, exists, size, allof, anyof, not,
+// true and false.
+//
+// Actions map onto the normal handler behavior:
+//   keep           forward to the private address as usual
+//   discard        don't forward
+//   fileinto "x"   forward to the private address tagged with +x
+//   redirect "a"   forward to address a
+//   notify "arn"   publish the message to the sns topic arn
+
+type sieveScript struct {
+	commands []sieveCommand
+}
+
+type sieveCommand struct {
+	name  string
+	args  []sieveArg
+	tests []sieveTest
+	block []sieveCommand
+	line  int
+}
+
+type sieveTest struct {
+	name  string
+	args  []sieveArg
+	tests []sieveTest
+	line  int
+}
+
+type sieveArgKind int
+
+const (
+	sieveArgTag sieveArgKind = iota
+	sieveArgStrings
+	sieveArgNumber
+)
+
+type sieveArg struct {
+	kind sieveArgKind
+	tag  string
+	strs []string
+	num  int64
+}
+
+// sieveResult is the set of actions a script produced for a message.
+type sieveResult struct {
+	keep     bool
+	fileinto []string
+	redirect []string
+	notify   []string
+}
+
+var sieveExtensions = map[string]bool{
+	"fileinto":                   true,
+	"enotify":                    true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+func parseSieve(src string) (*sieveScript, error) {
+	p := &sieveParser{lex: &sieveLexer{src: src, line: 1}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	cmds, err := p.parseCommands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != sieveTokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+
+	if err := validateSieveCommands(cmds, true); err != nil {
+		return nil, err
+	}
+
+	return &sieveScript{commands: cmds}, nil
+}
+
+func (s *sieveScript) eval(msg routeMsg) (sieveResult, error) {
+	e := sieveEvaluator{
+		msg: msg,
+	}
+
+	if err := e.run(s.commands); err != nil && err != errSieveStop {
+		return sieveResult{}, err
+	}
+
+	res := e.result
+	res.keep = e.explicitKeep || !e.cancelKeep
+	return res, nil
+}
+
+var errSieveStop = fmt.Errorf("sieve stop")
+
+type sieveEvaluator struct {
+	msg          routeMsg
+	result       sieveResult
+	explicitKeep bool
+	cancelKeep   bool
+}
+
+func (e *sieveEvaluator) run(cmds []sieveCommand) error {
+	var prevMatched, inChain bool
+
+	for _, cmd := range cmds {
+		switch cmd.name {
+		case "require":
+		case "if":
+			match, err := e.test(cmd.tests[0])
+			if err != nil {
+				return err
+			}
+			inChain, prevMatched = true, match
+			if match {
+				if err := e.run(cmd.block); err != nil {
+					return err
+				}
+			}
+			continue
+		case "elsif":
+			if !inChain || prevMatched {
+				continue
+			}
+			match, err := e.test(cmd.tests[0])
+			if err != nil {
+				return err
+			}
+			prevMatched = match
+			if match {
+				if err := e.run(cmd.block); err != nil {
+					return err
+				}
+			}
+			continue
+		case "else":
+			if inChain && !prevMatched {
+				if err := e.run(cmd.block); err != nil {
+					return err
+				}
+			}
+		case "stop":
+			return errSieveStop
+		case "keep":
+			e.explicitKeep = true
+		case "discard":
+			e.cancelKeep = true
+		case "fileinto":
+			e.cancelKeep = true
+			e.result.fileinto = appendUnique(e.result.fileinto, cmd.args[len(cmd.args)-1].strs[0])
+		case "redirect":
+			e.cancelKeep = true
+			e.result.redirect = appendUnique(e.result.redirect, cmd.args[len(cmd.args)-1].strs[0])
+		case "notify":
+			e.result.notify = appendUnique(e.result.notify, cmd.args[len(cmd.args)-1].strs[0])
+		}
+		inChain = false
+	}
+
+	return nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func (e *sieveEvaluator) test(t sieveTest) (bool, error) {
+	switch t.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		match, err := e.test(t.tests[0])
+		return !match, err
+	case "allof":
+		for _, sub := range t.tests {
+			match, err := e.test(sub)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	case "anyof":
+		for _, sub := range t.tests {
+			match, err := e.test(sub)
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case "exists":
+		for _, name := range t.args[0].strs {
+			if e.msg.env == nil || len(e.msg.env.GetHeaderValues(name)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		var (
+			over  bool
+			limit int64
+		)
+		for _, arg := range t.args {
+			switch arg.kind {
+			case sieveArgTag:
+				over = arg.tag == ":over"
+			case sieveArgNumber:
+				limit = arg.num
+			}
+		}
+		if over {
+			return int64(e.msg.size) > limit, nil
+		}
+		return int64(e.msg.size) < limit, nil
+	case "header", "address":
+		m, err := newSieveMatcher(t.args)
+		if err != nil {
+			return false, fmt.Errorf("sieve line %d: %w", t.line, err)
+		}
+
+		for _, name := range m.headers {
+			for _, value := range e.headerValues(name) {
+				if t.name == "header" {
+					if m.match(value) {
+						return true, nil
+					}
+					continue
+				}
+
+				for _, addr := range m.addressParts(value) {
+					if m.match(addr) {
+						return true, nil
+					}
+				}
+			}
+		}
+		return false, nil
+	}
+
+	return false, fmt.Errorf("sieve line %d: unsupported test %s", t.line, t.name)
+}
+
+func (e *sieveEvaluator) headerValues(name string) []string {
+	if e.msg.env == nil {
+		return nil
+	}
+	return e.msg.env.GetHeaderValues(name)
+}
+
+type sieveMatcher struct {
+	matchType   string
+	addressPart string
+	octet       bool
+	headers     []string
+	keys        []string
+	keyRes      []*regexp.Regexp
+}
+
+func newSieveMatcher(args []sieveArg) (*sieveMatcher, error) {
+	m := sieveMatcher{
+		matchType:   ":is",
+		addressPart: ":all",
+	}
+
+	var (
+		lists          [][]string
+		wantComparator bool
+	)
+	for _, arg := range args {
+		switch arg.kind {
+		case sieveArgTag:
+			switch arg.tag {
+			case ":is", ":contains", ":matches":
+				m.matchType = arg.tag
+			case ":all", ":localpart", ":domain":
+				m.addressPart = arg.tag
+			case ":comparator":
+				wantComparator = true
+			}
+		case sieveArgStrings:
+			if wantComparator {
+				m.octet = arg.strs[0] == "i;octet"
+				wantComparator = false
+				continue
+			}
+			lists = append(lists, arg.strs)
+		}
+	}
+
+	m.headers = lists[0]
+	m.keys = lists[1]
+
+	if m.matchType == ":matches" {
+		for _, key := range m.keys {
+			re, err := sieveGlobRe(key, !m.octet)
+			if err != nil {
+				return nil, err
+			}
+			m.keyRes = append(m.keyRes, re)
+		}
+	}
+
+	return &m, nil
+}
+
+func (m *sieveMatcher) match(value string) bool {
+	for i, key := range m.keys {
+		switch m.matchType {
+		case ":is":
+			if m.octet && value == key || !m.octet && strings.EqualFold(value, key) {
+				return true
+			}
+		case ":contains":
+			if m.octet && strings.Contains(value, key) || !m.octet && strings.Contains(strings.ToLower(value), strings.ToLower(key)) {
+				return true
+			}
+		case ":matches":
+			if m.keyRes[i].MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *sieveMatcher) addressParts(value string) []string {
+	addrs, err := gomail.ParseAddressList(value)
+	if err != nil {
+		return nil
+	}
+
+	parts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		a := addr.Address
+		at := strings.LastIndex(a, "@")
+		switch m.addressPart {
+		case ":localpart":
+			if at >= 0 {
+				a = a[:at]
+			}
+		case ":domain":
+			a = a[at+1:]
+		}
+		parts = append(parts, a)
+	}
+	return parts
+}
+
+// sieveGlobRe converts a sieve :matches pattern into a regexp.
+func sieveGlobRe(pattern string, caseInsensitive bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^(?s)")
+	if caseInsensitive {
+		b.WriteString("(?i)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+type sieveCommandSpec struct {
+	// tags the command accepts. If a tag takes a value, valueTags
+	// is set to the kind of value it takes.
+	tags      map[string]bool
+	valueTags map[string]sieveArgKind
+	// number of positional string arguments
+	strings int
+	test    bool
+	block   bool
+}
+
+var sieveCommands = map[string]sieveCommandSpec{
+	"require":  {strings: 1},
+	"if":       {test: true, block: true},
+	"elsif":    {test: true, block: true},
+	"else":     {block: true},
+	"stop":     {},
+	"keep":     {},
+	"discard":  {},
+	"fileinto": {strings: 1},
+	"redirect": {strings: 1},
+	"notify": {
+		strings: 1,
+		valueTags: map[string]sieveArgKind{
+			":from":       sieveArgStrings,
+			":importance": sieveArgStrings,
+			":options":    sieveArgStrings,
+			":message":    sieveArgStrings,
+		},
+	},
+}
+
+var sieveTests = map[string]sieveCommandSpec{
+	"true":  {},
+	"false": {},
+	"not":   {test: true},
+	"allof": {test: true},
+	"anyof": {test: true},
+	"exists": {
+		strings: 1,
+	},
+	"size": {
+		tags: map[string]bool{":over": true, ":under": true},
+	},
+	"header": {
+		strings:   2,
+		tags:      map[string]bool{":is": true, ":contains": true, ":matches": true},
+		valueTags: map[string]sieveArgKind{":comparator": sieveArgStrings},
+	},
+	"address": {
+		strings:   2,
+		tags:      map[string]bool{":is": true, ":contains": true, ":matches": true, ":all": true, ":localpart": true, ":domain": true},
+		valueTags: map[string]sieveArgKind{":comparator": sieveArgStrings},
+	},
+}
+
+func validateSieveCommands(cmds []sieveCommand, topLevel bool) error {
+	var (
+		requiresAllowed = topLevel
+		required        = make(map[string]bool)
+		prevIf          bool
+	)
+
+	for _, cmd := range cmds {
+		spec, ok := sieveCommands[cmd.name]
+		if !ok {
+			return fmt.Errorf("sieve line %d: unsupported command %s", cmd.line, cmd.name)
+		}
+
+		if cmd.name == "require" {
+			if !requiresAllowed {
+				return fmt.Errorf("sieve line %d: require must come before other commands", cmd.line)
+			}
+		} else {
+			requiresAllowed = false
+		}
+
+		if (cmd.name == "elsif" || cmd.name == "else") && !prevIf {
+			return fmt.Errorf("sieve line %d: %s without if", cmd.line, cmd.name)
+		}
+		prevIf = cmd.name == "if" || cmd.name == "elsif"
+
+		if err := validateSieveArgs(cmd.name, cmd.line, spec, cmd.args); err != nil {
+			return err
+		}
+
+		if spec.test && len(cmd.tests) != 1 {
+			return fmt.Errorf("sieve line %d: %s requires a single test", cmd.line, cmd.name)
+		} else if !spec.test && len(cmd.tests) > 0 {
+			return fmt.Errorf("sieve line %d: %s does not take a test", cmd.line, cmd.name)
+		}
+		for _, t := range cmd.tests {
+			if err := validateSieveTest(t); err != nil {
+				return err
+			}
+		}
+
+		if spec.block && cmd.block == nil {
+			return fmt.Errorf("sieve line %d: %s requires a block", cmd.line, cmd.name)
+		} else if !spec.block && cmd.block != nil {
+			return fmt.Errorf("sieve line %d: %s does not take a block", cmd.line, cmd.name)
+		}
+		if err := validateSieveCommands(cmd.block, false); err != nil {
+			return err
+		}
+
+		if cmd.name == "require" {
+			for _, ext := range cmd.args[0].strs {
+				if !sieveExtensions[ext] {
+					return fmt.Errorf("sieve line %d: unsupported extension %q", cmd.line, ext)
+				}
+				required[ext] = true
+			}
+		}
+
+		if cmd.name == "notify" {
+			method := cmd.args[len(cmd.args)-1].strs[0]
+			if !strings.HasPrefix(method, "arn:aws:sns:") {
+				return fmt.Errorf("sieve line %d: notify method must be an sns topic arn, got %q", cmd.line, method)
+			}
+		}
+		if cmd.name == "redirect" {
+			if _, err := gomail.ParseAddress(cmd.args[0].strs[0]); err != nil {
+				return fmt.Errorf("sieve line %d: invalid redirect address %q", cmd.line, cmd.args[0].strs[0])
+			}
+		}
+	}
+
+	if topLevel {
+		return checkSieveRequires(cmds, required)
+	}
+
+	return nil
+}
+
+// checkSieveRequires verifies that extensions used inside nested
+// blocks were declared at the top of the script.
+func checkSieveRequires(cmds []sieveCommand, required map[string]bool) error {
+	for _, cmd := range cmds {
+		switch cmd.name {
+		case "fileinto":
+			if !required["fileinto"] {
+				return fmt.Errorf("sieve line %d: fileinto requires 'require \"fileinto\"'", cmd.line)
+			}
+		case "notify":
+			if !required["enotify"] {
+				return fmt.Errorf("sieve line %d: notify requires 'require \"enotify\"'", cmd.line)
+			}
+		}
+		if err := checkSieveRequires(cmd.block, required); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateSieveTest(t sieveTest) error {
+	spec, ok := sieveTests[t.name]
+	if !ok {
+		return fmt.Errorf("sieve line %d: unsupported test %s", t.line, t.name)
+	}
+
+	if err := validateSieveArgs(t.name, t.line, spec, t.args); err != nil {
+		return err
+	}
+
+	switch t.name {
+	case "not":
+		if len(t.tests) != 1 {
+			return fmt.Errorf("sieve line %d: not requires a single test", t.line)
+		}
+	case "allof", "anyof":
+		if len(t.tests) == 0 {
+			return fmt.Errorf("sieve line %d: %s requires a test list", t.line, t.name)
+		}
+	case "size":
+		var haveTag, haveNum bool
+		for _, arg := range t.args {
+			haveTag = haveTag || arg.kind == sieveArgTag
+			haveNum = haveNum || arg.kind == sieveArgNumber
+		}
+		if !haveTag || !haveNum {
+			return fmt.Errorf("sieve line %d: size requires :over or :under and a number", t.line)
+		}
+	default:
+		if len(t.tests) > 0 {
+			return fmt.Errorf("sieve line %d: %s does not take a test", t.line, t.name)
+		}
+	}
+
+	for i, arg := range t.args {
+		if arg.kind == sieveArgTag && arg.tag == ":comparator" {
+			comparator := t.args[i+1].strs[0]
+			if comparator != "i;octet" && comparator != "i;ascii-casemap" {
+				return fmt.Errorf("sieve line %d: unsupported comparator %q", t.line, comparator)
+			}
+		}
+	}
+
+	for _, sub := range t.tests {
+		if err := validateSieveTest(sub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateSieveArgs(name string, line int, spec sieveCommandSpec, args []sieveArg) error {
+	var (
+		positional int
+		wantValue  bool
+		valueKind  sieveArgKind
+	)
+
+	for _, arg := range args {
+		if wantValue {
+			if arg.kind != valueKind {
+				return fmt.Errorf("sieve line %d: %s: missing tag value", line, name)
+			}
+			wantValue = false
+			continue
+		}
+
+		switch arg.kind {
+		case sieveArgTag:
+			if positional > 0 {
+				return fmt.Errorf("sieve line %d: %s: tag %s must come before positional arguments", line, name, arg.tag)
+			}
+			if kind, ok := spec.valueTags[arg.tag]; ok {
+				wantValue = true
+				valueKind = kind
+			} else if !spec.tags[arg.tag] {
+				return fmt.Errorf("sieve line %d: %s: unsupported tag %s", line, name, arg.tag)
+			}
+		case sieveArgStrings:
+			positional++
+		case sieveArgNumber:
+			if name != "size" {
+				return fmt.Errorf("sieve line %d: %s: unexpected number", line, name)
+			}
+		}
+	}
+
+	if wantValue {
+		return fmt.Errorf("sieve line %d: %s: missing tag value", line, name)
+	}
+
+	if positional != spec.strings {
+		return fmt.Errorf("sieve line %d: %s expects %d string arguments, got %d", line, name, spec.strings, positional)
+	}
+
+	return nil
+}
+
+type sieveParser struct {
+	lex *sieveLexer
+	tok sieveToken
+}
+
+func (p *sieveParser) next() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *sieveParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("sieve line %d: %s", p.tok.line, fmt.Sprintf(format, args...))
+}
+
+func (p *sieveParser) parseCommands() ([]sieveCommand, error) {
+	cmds := []sieveCommand{}
+	for p.tok.kind == sieveTokIdent {
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *sieveParser) parseCommand() (sieveCommand, error) {
+	cmd := sieveCommand{
+		name: strings.ToLower(p.tok.text),
+		line: p.tok.line,
+	}
+	if err := p.next(); err != nil {
+		return cmd, err
+	}
+
+	args, tests, err := p.parseArguments()
+	if err != nil {
+		return cmd, err
+	}
+	cmd.args = args
+	cmd.tests = tests
+
+	switch p.tok.kind {
+	case sieveTokSemicolon:
+		return cmd, p.next()
+	case sieveTokLBrace:
+		if err := p.next(); err != nil {
+			return cmd, err
+		}
+		block, err := p.parseCommands()
+		if err != nil {
+			return cmd, err
+		}
+		if p.tok.kind != sieveTokRBrace {
+			return cmd, p.errorf("expected } but got %s", p.tok)
+		}
+		cmd.block = block
+		return cmd, p.next()
+	}
+
+	return cmd, p.errorf("expected ; or { but got %s", p.tok)
+}
+
+func (p *sieveParser) parseArguments() ([]sieveArg, []sieveTest, error) {
+	var args []sieveArg
+	for {
+		switch p.tok.kind {
+		case sieveTokTag:
+			args = append(args, sieveArg{kind: sieveArgTag, tag: strings.ToLower(p.tok.text)})
+		case sieveTokNumber:
+			args = append(args, sieveArg{kind: sieveArgNumber, num: p.tok.num})
+		case sieveTokString:
+			args = append(args, sieveArg{kind: sieveArgStrings, strs: []string{p.tok.text}})
+		case sieveTokLBracket:
+			strs, err := p.parseStringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, sieveArg{kind: sieveArgStrings, strs: strs})
+		case sieveTokIdent:
+			t, err := p.parseTest()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []sieveTest{t}, nil
+		case sieveTokLParen:
+			tests, err := p.parseTestList()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, tests, nil
+		default:
+			return args, nil, nil
+		}
+		if err := p.next(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *sieveParser) parseStringList() ([]string, error) {
+	var strs []string
+	for {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != sieveTokString {
+			return nil, p.errorf("expected string but got %s", p.tok)
+		}
+		strs = append(strs, p.tok.text)
+
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		switch p.tok.kind {
+		case sieveTokComma:
+			continue
+		case sieveTokRBracket:
+			return strs, nil
+		default:
+			return nil, p.errorf("expected , or ] but got %s", p.tok)
+		}
+	}
+}
+
+func (p *sieveParser) parseTest() (sieveTest, error) {
+	t := sieveTest{
+		name: strings.ToLower(p.tok.text),
+		line: p.tok.line,
+	}
+	if err := p.next(); err != nil {
+		return t, err
+	}
+
+	args, tests, err := p.parseArguments()
+	t.args = args
+	t.tests = tests
+	return t, err
+}
+
+func (p *sieveParser) parseTestList() ([]sieveTest, error) {
+	var tests []sieveTest
+	for {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != sieveTokIdent {
+			return nil, p.errorf("expected test but got %s", p.tok)
+		}
+		t, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+
+		switch p.tok.kind {
+		case sieveTokComma:
+			continue
+		case sieveTokRParen:
+			return tests, p.next()
+		default:
+			return nil, p.errorf("expected , or ) but got %s", p.tok)
+		}
+	}
+}
+
+type sieveTokKind int
+
+const (
+	sieveTokEOF sieveTokKind = iota
+	sieveTokIdent
+	sieveTokTag
+	sieveTokString
+	sieveTokNumber
+	sieveTokLBracket
+	sieveTokRBracket
+	sieveTokLParen
+	sieveTokRParen
+	sieveTokLBrace
+	sieveTokRBrace
+	sieveTokComma
+	sieveTokSemicolon
+)
+
+type sieveToken struct {
+	kind sieveTokKind
+	text string
+	num  int64
+	line int
+}
+
+func (t sieveToken) String() string {
+	switch t.kind {
+	case sieveTokEOF:
+		return "end of script"
+	case sieveTokString:
+		return strconv.Quote(t.text)
+	case sieveTokNumber:
+		return strconv.FormatInt(t.num, 10)
+	}
+	return t.text
+}
+
+type sieveLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *sieveLexer) next() (sieveToken, error) {
+	if err := l.skipSpace(); err != nil {
+		return sieveToken{}, err
+	}
+
+	tok := sieveToken{line: l.line}
+	if l.pos >= len(l.src) {
+		tok.kind = sieveTokEOF
+		return tok, nil
+	}
+
+	c := l.src[l.pos]
+	punct := map[byte]sieveTokKind{
+		'[': sieveTokLBracket,
+		']': sieveTokRBracket,
+		'(': sieveTokLParen,
+		')': sieveTokRParen,
+		'{': sieveTokLBrace,
+		'}': sieveTokRBrace,
+		',': sieveTokComma,
+		';': sieveTokSemicolon,
+	}
+	if kind, ok := punct[c]; ok {
+		l.pos++
+		tok.kind = kind
+		tok.text = string(c)
+		return tok, nil
+	}
+
+	switch {
+	case c == '"':
+		s, err := l.quoted()
+		tok.kind = sieveTokString
+		tok.text = s
+		return tok, err
+	case c == ':':
+		l.pos++
+		tok.kind = sieveTokTag
+		tok.text = ":" + l.ident()
+		if tok.text == ":" {
+			return tok, fmt.Errorf("sieve line %d: empty tag", l.line)
+		}
+		return tok, nil
+	case c >= '0' && c <= '9':
+		start := l.pos
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return tok, fmt.Errorf("sieve line %d: invalid number: %w", l.line, err)
+		}
+		if l.pos < len(l.src) {
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				n <<= 10
+				l.pos++
+			case 'M', 'm':
+				n <<= 20
+				l.pos++
+			case 'G', 'g':
+				n <<= 30
+				l.pos++
+			}
+		}
+		tok.kind = sieveTokNumber
+		tok.num = n
+		return tok, nil
+	case isSieveIdentStart(c):
+		id := l.ident()
+		if strings.EqualFold(id, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiline()
+			tok.kind = sieveTokString
+			tok.text = s
+			return tok, err
+		}
+		tok.kind = sieveTokIdent
+		tok.text = id
+		return tok, nil
+	}
+
+	return tok, fmt.Errorf("sieve line %d: unexpected character %q", l.line, c)
+}
+
+func isSieveIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (l *sieveLexer) ident() string {
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if !isSieveIdentStart(c) && !(c >= '0' && c <= '9') {
+			break
+		}
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+func (l *sieveLexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("sieve line %d: unterminated comment", l.line)
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *sieveLexer) quoted() (string, error) {
+	startLine := l.line
+	l.pos++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+	}
+
+	return "", fmt.Errorf("sieve line %d: unterminated string", startLine)
+}
+
+// multiline reads a "text:" string terminated by a line containing
+// a single ".".
+func (l *sieveLexer) multiline() (string, error) {
+	startLine := l.line
+
+	eol := strings.IndexByte(l.src[l.pos:], '\n')
+	if eol < 0 {
+		return "", fmt.Errorf("sieve line %d: unterminated multi-line string", startLine)
+	}
+	l.pos += eol + 1
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var line string
+		if end < 0 {
+			line = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			line = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+		}
+		l.line++
+
+		line = strings.TrimSuffix(line, "\r")
+		if line == "." {
+			return b.String(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	return "", fmt.Errorf("sieve line %d: unterminated multi-line string", startLine)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+func TestSieve(t *testing.T) {
+	raw := "From: Order Desk <orders@shop.example.com>\r\n" +
+		"To: shop@my-ses-email-domain.example.com\r\n" +
+		"Cc: Someone <someone@example.com>\r\n" +
+		"Subject: Your order #1234 has shipped\r\n" +
+		"X-SES-Spam-Verdict: PASS\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Thanks for your order.\r\n"
+
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := routeMsg{
+		from:    "orders@shop.example.com",
+		to:      []string{"shop@my-ses-email-domain.example.com"},
+		subject: env.GetHeader("Subject"),
+		size:    len(raw),
+		env:     env,
+	}
+
+	checks := []struct {
+		name   string
+		script string
+		expect sieveResult
+	}{
+		{
+			name:   "empty_script_keeps",
+			script: "",
+			expect: sieveResult{keep: true},
+		},
+		{
+			name: "discard",
+			script: `if address :domain "from" "shop.example.com" {
+  discard;
+}`,
+			expect: sieveResult{},
+		},
+		{
+			name: "fileinto_and_notify",
+			script: `require ["fileinto", "enotify"];
+# receipts
+if allof (header :contains "subject" "ORDER", exists ["cc", "to"]) {
+  fileinto "receipts";
+  notify :message "new order" "arn:aws:sns:us-east-1:123456789012:orders";
+  stop;
+}
+discard;`,
+			expect: sieveResult{
+				fileinto: []string{"receipts"},
+				notify:   []string{"arn:aws:sns:us-east-1:123456789012:orders"},
+			},
+		},
+		{
+			name: "elsif_else",
+			script: `if header :is "subject" "nope" {
+  discard;
+} elsif anyof (size :over 1M, address :localpart :is "to" "other") {
+  redirect "a@example.com";
+} else {
+  redirect "b@example.com";
+  keep;
+}`,
+			expect: sieveResult{
+				keep:     true,
+				redirect: []string{"b@example.com"},
+			},
+		},
+		{
+			name: "matches_and_not",
+			script: `if not address :matches :all "from" "*@shop.example.???" {
+  discard;
+}
+if header :matches :comparator "i;octet" "subject" "your order*" {
+  discard;
+}
+/* size is under 1K */
+if size :under 1K {
+  redirect "small@example.com";
+}`,
+			expect: sieveResult{
+				redirect: []string{"small@example.com"},
+			},
+		},
+	}
+
+	for _, c := range checks {
+		script, err := parseSieve(c.script)
+		if err != nil {
+			t.Fatalf("%s: parse err: %s", c.name, err)
+		}
+
+		got, err := script.eval(msg)
+		if err != nil {
+			t.Fatalf("%s: eval err: %s", c.name, err)
+		}
+
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("%s: got %+v expected %+v", c.name, got, c.expect)
+		}
+	}
+}
+
+func TestSieveParseErrors(t *testing.T) {
+	scripts := []string{
+		`fileinto "receipts";`,
+		`require "vacation";`,
+		`discard; require "fileinto";`,
+		`if header "subject" "x" { discard; `,
+		`else { discard; }`,
+		`if frobnicate "x" { discard; }`,
+		`if header :regex "subject" "x" { discard; }`,
+		`require "enotify"; notify "mailto:a@example.com";`,
+		`redirect "not an address";`,
+		`if size 100 { discard; }`,
+		`keep`,
+		`if header "subject" "unterminated { discard; }`,
+	}
+
+	for _, script := range scripts {
+		if _, err := parseSieve(script); err == nil {
+			t.Errorf("expected parse error for %q", script)
+		}
+	}
+}
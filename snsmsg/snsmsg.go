@@ -7,4 +7,24 @@ type Msg struct {
 	Subject      string   `json:"subject"`
 	Date         string   `json:"date"`
 	PresignedURL string   `json:"presigned_url"`
+
+	// Text and HTML are only included for webhooks with include_body set
+	Text string `json:"text,omitempty"`
+	HTML string `json:"html,omitempty"`
+
+	// Attachments saved to the bucket by an attachments route action
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Codes and Links are one-time codes and verification links
+	// found by an extract route action
+	Codes []string `json:"codes,omitempty"`
+	Links []string `json:"links,omitempty"`
+}
+
+type Attachment struct {
+	FileName     string `json:"filename"`
+	ContentType  string `json:"content_type"`
+	Size         int    `json:"size"`
+	Key          string `json:"key"`
+	PresignedURL string `json:"presigned_url"`
 }
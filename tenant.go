@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+const tenantConfigExt = ".toml"
+
+// Tenants loads a config for each hosted tenant, one file per tenant
+// named after its domain (example.org.toml), from a local directory
+// or from a prefix in the message bucket. A tenant config has the
+// same fields as the top level config. aws_region and the bucket
+// name and msg_prefix default to the top level values; the other
+// bucket prefixes default to the top level prefix followed by the
+// tenant's domain so that each tenant's forward metadata, outbox,
+// quarantine, autoreply, digest, quota, alias, feed and attachment
+// state is kept apart. A tenant whose state keys, including route
+// archive, attachment and feed keys, may overlap those of the top
+// level config or another tenant is rejected.
+type Tenants struct {
+	Dir      string `toml:"dir"`
+	S3Prefix string `toml:"s3_prefix"`
+}
+
+func (t *Tenants) validate() error {
+	if t.Dir != "" && t.S3Prefix != "" {
+		return errors.New("tenants.dir and tenants.s3_prefix are mutually exclusive")
+	}
+	return nil
+}
+
+// loadTenants loads, validates and compiles the tenant configs.
+func (c *Config) loadTenants() error {
+	files, err := c.Tenants.read()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	domains := make(map[string]string)
+	for _, d := range c.domainNames {
+		domains[d] = "the top level config"
+	}
+	owners := []stateOwner{
+		{name: "the top level config", domain: strings.ToLower(c.Domain), prefixes: c.statePrefixes()},
+	}
+
+	var tenants []*Config
+	for _, name := range names {
+		t, err := c.tenant(name, files[name])
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+
+		for _, d := range t.domainNames {
+			if other, ok := domains[d]; ok {
+				return fmt.Errorf("tenant %s: domain %s is already used by %s", name, d, other)
+			}
+			domains[d] = "tenant " + name
+		}
+		owner := stateOwner{name: "tenant " + name, domain: strings.ToLower(name), prefixes: t.statePrefixes()}
+		for _, other := range owners {
+			if err := owner.overlaps(other); err != nil {
+				return fmt.Errorf("tenant %s: %w", name, err)
+			}
+		}
+		owners = append(owners, owner)
+
+		if w := t.digestLinkWarning(); w != "" {
+			log15.New("tenant", name).Warn("digest_link_expiry", "warning", w)
+		}
+
+		if err := t.loadSieve(); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		tenants = append(tenants, t)
+	}
+
+	c.tenants = tenants
+	return nil
+}
+
+// tenant parses the config for the tenant domain.
+func (c *Config) tenant(domain string, data []byte) (*Config, error) {
+	var t Config
+	if err := toml.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+
+	if t.Domain == "" {
+		t.Domain = domain
+	}
+	if !strings.EqualFold(t.Domain, domain) {
+		return nil, fmt.Errorf("domain %s does not match the file name", t.Domain)
+	}
+	if t.Tenants != (Tenants{}) {
+		return nil, errors.New("tenants can only be set in the top level config")
+	}
+	if t.AwsRegion == "" {
+		t.AwsRegion = c.AwsRegion
+	}
+
+	sub := func(prefix string) string {
+		return path.Join(prefix, strings.ToLower(domain))
+	}
+	t.Bucket = t.Bucket.inherit(Bucket{
+		Name:              c.Bucket.Name,
+		MsgPrefix:         c.Bucket.MsgPrefix,
+		ForwardMetaPrefix: sub(c.Bucket.ForwardMetaPrefix),
+		OutboxPrefix:      sub(c.Bucket.OutboxPrefix),
+		QuarantinePrefix:  sub(c.QuarantinePrefix()),
+		AutoreplyPrefix:   sub(c.AutoreplyPrefix()),
+		DigestPrefix:      sub(c.DigestPrefix()),
+		QuotaPrefix:       sub(c.QuotaPrefix()),
+		AliasPrefix:       sub(c.AliasPrefix()),
+		FeedPrefix:        sub(c.FeedPrefix()),
+		AttachmentPrefix:  sub(c.AttachmentPrefix()),
+	})
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// statePrefix is a key prefix a config writes state under.
+type statePrefix struct {
+	// field names the setting the prefix comes from
+	field  string
+	bucket string
+	// keys is the literal prefix of every key written. It ends in
+	// "/" unless the rest of the last path element comes from a key
+	// template.
+	keys string
+	// exclusive is set when no other owner's prefix may nest inside
+	// this one, even under its own domain
+	exclusive bool
+}
+
+// statePrefixes returns the key prefixes c and its proxy domains
+// write state under. msg_prefix is shared by every config so it is
+// not included. tenants.s3_prefix is listed recursively when the
+// tenants are loaded, so it is exclusive.
+func (c *Config) statePrefixes() []statePrefix {
+	prefixes := c.domainStatePrefixes("")
+	for i, dc := range c.domains {
+		prefixes = append(prefixes, dc.domainStatePrefixes(fmt.Sprintf("proxy_domain[%d].", i))...)
+	}
+	if c.Tenants.S3Prefix != "" {
+		prefixes = append(prefixes, statePrefix{
+			field:     "tenants.s3_prefix",
+			bucket:    c.Bucket.Name,
+			keys:      keyPrefix(c.Tenants.S3Prefix),
+			exclusive: true,
+		})
+	}
+	return prefixes
+}
+
+func (c *Config) domainStatePrefixes(name string) []statePrefix {
+	var prefixes []statePrefix
+	add := func(field, tmpl string) {
+		if tmpl == "" {
+			return
+		}
+		prefixes = append(prefixes, statePrefix{
+			field:  name + field,
+			bucket: c.Bucket.Name,
+			keys:   keyPrefix(tmpl),
+		})
+	}
+
+	add("bucket.forward_meta_prefix", c.Bucket.ForwardMetaPrefix)
+	add("bucket.outbox_prefix", c.Bucket.OutboxPrefix)
+	add("bucket.quarantine_prefix", c.QuarantinePrefix())
+	add("bucket.autoreply_prefix", c.AutoreplyPrefix())
+	add("bucket.digest_prefix", c.DigestPrefix())
+	add("bucket.quota_prefix", c.QuotaPrefix())
+	add("bucket.alias_prefix", c.AliasPrefix())
+	add("bucket.feed_prefix", c.FeedPrefix())
+	add("bucket.attachment_prefix", c.AttachmentPrefix())
+
+	for i, r := range c.Routes {
+		route := fmt.Sprintf("route[%d]", i)
+		if r.Archive != nil {
+			add(route+".archive.prefix", r.Archive.Prefix)
+		}
+		if r.Attachments != nil {
+			add(route+".attachments.key", r.Attachments.Key)
+		}
+		if r.Feed != nil {
+			add(route+".feed.key", r.Feed.Key)
+			add(route+".feed.image_prefix", r.Feed.ImagePrefix)
+		}
+	}
+	return prefixes
+}
+
+// keyPrefix returns the literal prefix of the keys written under the
+// key or key template tmpl.
+func keyPrefix(tmpl string) string {
+	lit := tmpl + "/"
+	if i := strings.Index(tmpl, "{{"); i >= 0 {
+		lit = tmpl[:i]
+	}
+	p := path.Join("/", lit)
+	if strings.HasSuffix(lit, "/") && p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// stateOwner is the top level config or a tenant, with the state
+// prefixes of its config.
+type stateOwner struct {
+	name string
+	// domain is the domain the tenant defaults nest its prefixes
+	// under.
+	domain   string
+	prefixes []statePrefix
+}
+
+// overlaps returns an error if any key o writes state under may also
+// be written by other. A prefix that nests inside another one under
+// its owner's domain, as the tenant defaults do, doesn't overlap
+// unless the outer prefix is exclusive. Only the literal part of key
+// templates is compared; this holds because the template fields from
+// the message can't contain path separators (see keyElement) and
+// archive and attachment keys outside of their template's literal
+// prefix are refused when they are written.
+func (o stateOwner) overlaps(other stateOwner) error {
+	for _, p := range o.prefixes {
+		for _, op := range other.prefixes {
+			if p.bucket != op.bucket {
+				continue
+			}
+			var conflict bool
+			switch {
+			case strings.HasPrefix(p.keys, op.keys):
+				conflict = !nested(p, op, o.domain)
+			case strings.HasPrefix(op.keys, p.keys):
+				conflict = !nested(op, p, other.domain)
+			}
+			if conflict {
+				return fmt.Errorf("%s %s overlaps %s of %s", p.field, p.keys, op.field, other.name)
+			}
+		}
+	}
+	return nil
+}
+
+// nested reports whether inner is nested inside outer under domain.
+func nested(inner, outer statePrefix, domain string) bool {
+	return !outer.exclusive && strings.HasSuffix(outer.keys, "/") && strings.HasPrefix(inner.keys, outer.keys+domain+"/")
+}
+
+// read returns the tenant config files keyed by domain.
+func (t *Tenants) read() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	switch {
+	case t.Dir != "":
+		matches, err := filepath.Glob(filepath.Join(t.Dir, "*"+tenantConfigExt))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			b, err := ioutil.ReadFile(m)
+			if err != nil {
+				return nil, err
+			}
+			files[strings.TrimSuffix(filepath.Base(m), tenantConfigExt)] = b
+		}
+	case t.S3Prefix != "":
+		keys, err := listKeys(strings.TrimSuffix(t.S3Prefix, "/") + "/")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !strings.HasSuffix(key, tenantConfigExt) {
+				continue
+			}
+			b, err := getTenantConfig(key)
+			if err != nil {
+				return nil, err
+			}
+			files[strings.TrimSuffix(path.Base(key), tenantConfigExt)] = b
+		}
+	}
+
+	return files, nil
+}
+
+func getTenantConfig(key string) ([]byte, error) {
+	obj, err := s3GetObj(&s3.GetObjectInput{
+		Bucket: &conf.Bucket.Name,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get tenant config %s err: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	b, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read tenant config %s err: %w", key, err)
+	}
+	return b, nil
+}
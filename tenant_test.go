@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-test/deep"
+)
+
+const testTenantConfig = `
+private_address  = "owner@mail.example.net"
+outbound_address = "outbound@tenant.example.org"
+
+[quota]
+daily_messages = 1
+`
+
+func TestTenants(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "tenant.example.org.toml"), []byte(testTenantConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf = &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		OutboundAddress:       "outbound@my-ses-email-domain.example.com",
+		AwsRegion:             "us-east-1",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			OutboxPrefix:      "/outbox",
+		},
+		Tenants: Tenants{Dir: dir},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.loadTenants(); err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := conf.forDomain("tenant.example.org")
+	if tenant == nil {
+		t.Fatal("expected a config for tenant.example.org")
+	}
+	expectBucket := Bucket{
+		Name:              "westerly-tapir",
+		MsgPrefix:         "/periphery-corollas",
+		ForwardMetaPrefix: "/Voldemort-wearily/tenant.example.org",
+		OutboxPrefix:      "/outbox/tenant.example.org",
+		QuarantinePrefix:  "/quarantine/tenant.example.org",
+		AutoreplyPrefix:   "/autoreply/tenant.example.org",
+		DigestPrefix:      "/digest/tenant.example.org",
+		QuotaPrefix:       "/quota/tenant.example.org",
+		AliasPrefix:       "/aliases/tenant.example.org",
+		FeedPrefix:        "/feeds/tenant.example.org",
+		AttachmentPrefix:  "/attachments/tenant.example.org",
+	}
+	if diff := deep.Equal(tenant.Bucket, expectBucket); diff != nil {
+		t.Errorf("tenant bucket: %s", diff)
+	}
+
+	root := conf
+	conf = tenant
+	var feed Feed
+	if got := feed.key("news"); got != "/feeds/tenant.example.org/news.xml" {
+		t.Errorf("tenant feed key got %s", got)
+	}
+	if got := feed.imagePrefix(); got != "/feeds/tenant.example.org/images" {
+		t.Errorf("tenant feed image prefix got %s", got)
+	}
+	conf = root
+
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+	s3ListObjs = fakeListObjs
+	defer func() {
+		sentEmails = nil
+	}()
+
+	log.SetOutput(ioutil.Discard)
+
+	b, err := os.ReadFile("test_data/msg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(id string) {
+		t.Helper()
+		sse := loadTestEvent(t)
+		sse.Records[0].SES.Mail.MessageID = id
+		sse.Records[0].SES.Mail.Timestamp = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		sse.Records[0].SES.Receipt.Recipients = []string{"test@tenant.example.org"}
+		putTestMessageBytes(t, id, b)
+
+		sentEmails = nil
+		if err := Handler(sse); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("tenant-msg-1")
+
+	if len(sentEmails) != 1 {
+		t.Fatalf("expected 1 forwarded email got %d", len(sentEmails))
+	}
+	sent := sentEmails[0]
+	if diff := deep.Equal(aws.StringValueSlice(sent.input.Destinations), []string{"owner+test@mail.example.net"}); diff != nil {
+		t.Errorf("forward destinations: %s", diff)
+	}
+	if got := *sent.input.Source; got != "test@tenant.example.org" {
+		t.Errorf("forward source got %s", got)
+	}
+
+	// forward metadata is kept under the tenant's prefix
+	var metaKeys []string
+	for k := range fakeS3 {
+		if k.key == "/Voldemort-wearily/"+sent.sendID || k.key == "/Voldemort-wearily/tenant.example.org/"+sent.sendID {
+			metaKeys = append(metaKeys, k.key)
+		}
+	}
+	if diff := deep.Equal(metaKeys, []string{"/Voldemort-wearily/tenant.example.org/" + sent.sendID}); diff != nil {
+		t.Errorf("forward metadata: %s", diff)
+	}
+
+	// a retry of the same message doesn't use more quota
+	send("tenant-msg-1")
+	if len(sentEmails) != 1 {
+		t.Errorf("expected retried message to be forwarded got %d", len(sentEmails))
+	}
+
+	send("tenant-msg-2")
+	if len(sentEmails) != 0 {
+		t.Errorf("expected message over quota not to be forwarded got %d", len(sentEmails))
+	}
+}
+
+func TestTenantConfig(t *testing.T) {
+	root := &Config{
+		Domain:                "my-ses-email-domain.example.com",
+		PrivateAccountAddress: "foo@gmail.example.com",
+		OutboundAddress:       "outbound@my-ses-email-domain.example.com",
+		AwsRegion:             "us-east-1",
+		Bucket: Bucket{
+			Name:              "westerly-tapir",
+			MsgPrefix:         "/periphery-corollas",
+			ForwardMetaPrefix: "/Voldemort-wearily",
+			OutboxPrefix:      "/outbox",
+		},
+	}
+	if err := root.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := func(setting string) string {
+		return strings.Replace(testTenantConfig, "[quota]", "[bucket]\n"+setting+"\n\n[quota]", 1)
+	}
+	route := func(setting string) string {
+		return testTenantConfig + "\n[[route]]\nsrc = \"/.*/\"\ndst = \"/.*/\"\n\n" + setting + "\n"
+	}
+
+	checks := []struct {
+		name   string
+		domain string
+		config string
+		valid  bool
+	}{
+		{"ok", "tenant.example.org", testTenantConfig, true},
+		{"domain_mismatch", "tenant.example.org", `domain = "other.example.org"` + testTenantConfig, false},
+		{"nested_tenants", "tenant.example.org", testTenantConfig + "[tenants]\ndir = \"more\"\n", false},
+		{"shared_forward_meta", "tenant.example.org", strings.Replace(testTenantConfig, "[quota]", "[bucket]\nforward_meta_prefix = \"/Voldemort-wearily\"\n\n[quota]", 1), false},
+		{"own_quarantine", "tenant.example.org", bucket("quarantine_prefix = \"/tenant-quarantine\""), true},
+		{"shared_quarantine", "tenant.example.org", bucket("quarantine_prefix = \"/quarantine\""), false},
+		{"nested_feed", "tenant.example.org", bucket("feed_prefix = \"/feeds/other.example.org\""), false},
+		{"parent_alias", "tenant.example.org", bucket("alias_prefix = \"/\""), false},
+		{"own_archive", "tenant.example.org", route("[route.archive]\nprefix = \"/archive/tenant.example.org/{{.Year}}\""), true},
+		{"archive_template", "tenant.example.org", route("[route.archive]\nprefix = \"/{{.Year}}\""), false},
+		{"shared_attachments", "tenant.example.org", route("[route.attachments]\nkey = \"/attachments/{{.MessageID}}/{{.FileName}}\""), false},
+		{"bad_outbound", "tenant.example.org", strings.Replace(testTenantConfig, "outbound@tenant.example.org", "outbound@example.com", 1), false},
+	}
+
+	for _, check := range checks {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, check.domain+".toml"), []byte(check.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c := *root
+		c.Tenants = Tenants{Dir: dir}
+		err := c.loadTenants()
+		if (err == nil) != check.valid {
+			t.Errorf("%s: valid=%t got err=%v", check.name, check.valid, err)
+		}
+	}
+
+	// tenant configs are listed recursively from tenants.s3_prefix,
+	// so no tenant may keep state under it, even under its domain
+	c := *root
+	c.Tenants = Tenants{S3Prefix: "/tenants"}
+	tc, err := c.tenant("tenant.example.org", []byte(route("[route.archive]\nprefix = \"/tenants/tenant.example.org/{{.Alias}}\"")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := stateOwner{name: "the top level config", domain: "my-ses-email-domain.example.com", prefixes: c.statePrefixes()}
+	tenant := stateOwner{name: "tenant tenant.example.org", domain: "tenant.example.org", prefixes: tc.statePrefixes()}
+	if err := tenant.overlaps(top); err == nil {
+		t.Errorf("expected tenant archive under tenants.s3_prefix to be rejected")
+	}
+}
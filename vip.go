@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	gomail "net/mail"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// vipNotificationLen keeps notifications within a single SMS.
+const vipNotificationLen = 160
+
+// VIP lists urgent senders and aliases. Matching messages are
+// forwarded with priority headers and, if SNS is set, announced on
+// that topic with a short sender and subject notification. The list
+// is checked independently of the routes.
+type VIP struct {
+	Senders []string `toml:"senders"`
+	Aliases []string `toml:"aliases"`
+	SNS     string   `toml:"sns"`
+
+	senders []*pattern
+	aliases []*pattern
+}
+
+// compile compiles the sender and alias patterns. Like route src and
+// dst they are exact addresses or regular expressions wrapped in
+// slashes.
+func (v *VIP) compile() error {
+	v.senders = nil
+	v.aliases = nil
+	for i, s := range v.Senders {
+		p, err := compilePattern(s)
+		if err != nil {
+			return fmt.Errorf("vip.senders[%d]: %w", i, err)
+		}
+		if p != nil {
+			v.senders = append(v.senders, p)
+		}
+	}
+	for i, s := range v.Aliases {
+		p, err := compilePattern(s)
+		if err != nil {
+			return fmt.Errorf("vip.aliases[%d]: %w", i, err)
+		}
+		if p != nil {
+			v.aliases = append(v.aliases, p)
+		}
+	}
+	return nil
+}
+
+// match reports whether the message is from a vip sender or to a
+// vip alias.
+func (v *VIP) match(from string, recipients []string) bool {
+	for _, p := range v.senders {
+		if p.matchAddr(from) {
+			return true
+		}
+	}
+	for _, p := range v.aliases {
+		for _, rcpt := range recipients {
+			if p.matchAddr(rcpt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// vipNotification returns the compact notification for a message:
+// the sender's name, or address, and the subject.
+func vipNotification(record events.SimpleEmailRecord) string {
+	var (
+		mail   = record.SES.Mail
+		sender = strings.Trim(mail.Source, "<>")
+	)
+	if len(mail.CommonHeaders.From) > 0 {
+		if addr, err := gomail.ParseAddress(mail.CommonHeaders.From[0]); err == nil {
+			sender = addr.Address
+			if addr.Name != "" {
+				sender = addr.Name
+			}
+		}
+	}
+
+	msg := []rune(fmt.Sprintf("%s: %s", sender, mail.CommonHeaders.Subject))
+	if len(msg) > vipNotificationLen {
+		msg = append(msg[:vipNotificationLen-3], []rune("...")...)
+	}
+	return string(msg)
+}
+
+func notifyVIP(topic string, record events.SimpleEmailRecord) error {
+	_, err := snsPublish(&sns.PublishInput{
+		TopicArn: aws.String(topic),
+		Message:  aws.String(vipNotification(record)),
+	})
+	if err != nil {
+		return fmt.Errorf("publish vip notification err: %w", err)
+	}
+	return nil
+}
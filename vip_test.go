@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/inconshreveable/log15"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestVIP(t *testing.T) {
+	var published []*sns.PublishInput
+	snsPublish = func(i *sns.PublishInput) (*sns.PublishOutput, error) {
+		published = append(published, i)
+		return &sns.PublishOutput{}, nil
+	}
+	defer func() {
+		snsPublish = fakeSNSPublish
+	}()
+	sendEmail = fakeSendEmail
+	s3GetObj = fakeGetObj
+	s3PutObj = fakePutObj
+
+	log.SetOutput(ioutil.Discard)
+
+	checks := []struct {
+		name   string
+		vip    VIP
+		spam   string
+		expect bool
+	}{
+		{"sender", VIP{Senders: []string{"psanford@example.com"}, SNS: "arn:aws:sns:us-east-1:123456789012:vip"}, "PASS", true},
+		{"sender_regex", VIP{Senders: []string{"/@example\\.com$/"}, SNS: "arn:aws:sns:us-east-1:123456789012:vip"}, "PASS", true},
+		{"alias", VIP{Aliases: []string{"test@my-ses-email-domain.example.com"}, SNS: "arn:aws:sns:us-east-1:123456789012:vip"}, "PASS", true},
+		{"no_match", VIP{Senders: []string{"boss@example.com"}, SNS: "arn:aws:sns:us-east-1:123456789012:vip"}, "PASS", false},
+		{"suspect", VIP{Senders: []string{"psanford@example.com"}, SNS: "arn:aws:sns:us-east-1:123456789012:vip"}, "FAIL", false},
+	}
+
+	for _, check := range checks {
+		conf = &Config{
+			Domain:                "my-ses-email-domain.example.com",
+			PrivateAccountAddress: "foo@gmail.example.com",
+			Bucket: Bucket{
+				Name:              "westerly-tapir",
+				MsgPrefix:         "/periphery-corollas",
+				ForwardMetaPrefix: "/Voldemort-wearily",
+			},
+			VIP: check.vip,
+		}
+		if err := conf.compile(); err != nil {
+			t.Fatal(err)
+		}
+
+		sse := loadTestEvent(t)
+		sse.Records[0].SES.Receipt.SpamVerdict.Status = check.spam
+		id := sse.Records[0].SES.Mail.MessageID
+		putTestMessage(t, id, "test_data/msg0")
+
+		sentEmails = nil
+		published = nil
+
+		if err := Handler(sse); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sentEmails) != 1 {
+			t.Fatalf("%s: expected 1 forwarded email got %d", check.name, len(sentEmails))
+		}
+		env, err := enmime.ReadEnvelope(bytes.NewReader(sentEmails[0].input.RawMessage.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotVIP := env.GetHeader("X-Lambdaemail-Priority") == "vip" && env.GetHeader("Importance") == "high"
+		if gotVIP != check.expect {
+			t.Errorf("%s: priority headers got %t expected %t", check.name, gotVIP, check.expect)
+		}
+
+		if !check.expect {
+			if len(published) != 0 {
+				t.Errorf("%s: expected no vip notification got %d", check.name, len(published))
+			}
+			continue
+		}
+		if len(published) != 1 {
+			t.Fatalf("%s: expected 1 vip notification got %d", check.name, len(published))
+		}
+		if got := *published[0].TopicArn; got != check.vip.SNS {
+			t.Errorf("%s: notification topic got %s", check.name, got)
+		}
+		expect := vipNotification(sse.Records[0])
+		if got := *published[0].Message; got != expect {
+			t.Errorf("%s: notification got %q expected %q", check.name, got, expect)
+		}
+	}
+}
+
+func TestVIPNotification(t *testing.T) {
+	var record events.SimpleEmailRecord
+	record.SES.Mail.Source = "alerts@bank.example.com"
+	record.SES.Mail.CommonHeaders.From = []string{"Example Bank <alerts@bank.example.com>"}
+	record.SES.Mail.CommonHeaders.Subject = "Large withdrawal"
+
+	if got, expect := vipNotification(record), "Example Bank: Large withdrawal"; got != expect {
+		t.Errorf("got %q expected %q", got, expect)
+	}
+
+	record.SES.Mail.CommonHeaders.From = nil
+	record.SES.Mail.CommonHeaders.Subject = string(bytes.Repeat([]byte("x"), 200))
+	got := []rune(vipNotification(record))
+	if len(got) != vipNotificationLen {
+		t.Errorf("expected notification truncated to %d got %d", vipNotificationLen, len(got))
+	}
+}
+
+// TestVIPNotDelivered checks that vip messages that aren't forwarded
+// don't send a notification.
+func TestVIPNotDelivered(t *testing.T) {
+	raw, err := os.ReadFile("test_data/msg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lgr := log15.New()
+	lgr.SetHandler(log15.DiscardHandler())
+	pl := &planner{
+		lgr: lgr,
+		getMessage: func(string) ([]byte, error) {
+			return raw, nil
+		},
+		released: func(string) bool {
+			return false
+		},
+	}
+
+	checks := []struct {
+		name   string
+		routes []Route
+		from   string
+	}{
+		{"drop", []Route{{Condition: Condition{Subject: "save off"}, Drop: true}}, ""},
+		{"bounce", []Route{{Condition: Condition{Subject: "save off"}, Bounce: &Bounce{}}}, ""},
+		{"skip_forwarding", []Route{{Condition: Condition{Subject: "save off"}, SNS: "arn:aws:sns:us-east-1:123456789012:saved"}}, ""},
+		{"owner_reply", nil, "foo@gmail.example.com"},
+	}
+
+	for _, check := range checks {
+		conf = &Config{
+			Domain:                "my-ses-email-domain.example.com",
+			PrivateAccountAddress: "foo@gmail.example.com",
+			Routes:                check.routes,
+			VIP: VIP{
+				Senders: []string{"psanford@example.com", "foo@gmail.example.com"},
+				SNS:     "arn:aws:sns:us-east-1:123456789012:vip",
+			},
+		}
+		if err := conf.compile(); err != nil {
+			t.Fatal(err)
+		}
+
+		record := loadTestEvent(t).Records[0]
+		if check.from != "" {
+			record.SES.Mail.CommonHeaders.From = []string{check.from}
+		}
+
+		p, err := pl.plan(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range p.actions {
+			if a.kind == actionVIPNotify {
+				t.Errorf("%s: unexpected vip notification: %v", check.name, p.actions)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/snsmsg"
+)
+
+const (
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookMaxAttempts = 3
+
+	webhookSignatureHeader = "X-Lambdaemail-Signature"
+	webhookTimestampHeader = "X-Lambdaemail-Timestamp"
+)
+
+var (
+	webhookClient  = http.DefaultClient
+	webhookBackoff = time.Second
+)
+
+// Webhook POSTs the route payload to URL. Requests are signed with
+// an HMAC-SHA256 of "<timestamp>.<body>" using Secret.
+type Webhook struct {
+	URL         string   `toml:"url"`
+	Secret      string   `toml:"secret"`
+	Timeout     duration `toml:"timeout"`
+	MaxAttempts int      `toml:"max_attempts"`
+	IncludeBody bool     `toml:"include_body"`
+}
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (w *Webhook) validate(name string) error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("%s: invalid url: %w", name, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s: url must be an https url", name)
+	}
+	if w.Secret == "" {
+		return fmt.Errorf("%s: secret must be set", name)
+	}
+	if w.Timeout.Duration < 0 || w.MaxAttempts < 0 {
+		return fmt.Errorf("%s: timeout and max_attempts must not be negative", name)
+	}
+	return nil
+}
+
+func postWebhook(w Webhook, msg snsmsg.Msg, body *enmime.Envelope) error {
+	id := msg.ID
+
+	if w.IncludeBody && body != nil {
+		msg.Text = body.Text
+		msg.HTML = body.HTML
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal webhook msg err: %w", err)
+	}
+
+	timeout := w.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	attempts := w.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultWebhookMaxAttempts
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = sendWebhook(w, payload, timeout)
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentWebhookErr
+		if errors.As(err, &permanent) || attempt >= attempts {
+			return fmt.Errorf("webhook %s for %s failed after %d attempts: %w", w.URL, id, attempt, err)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// permanentWebhookErr is returned for responses that should not
+// be retried.
+type permanentWebhookErr struct {
+	err error
+}
+
+func (e *permanentWebhookErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentWebhookErr) Unwrap() error {
+	return e.err
+}
+
+func sendWebhook(w Webhook, payload []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return &permanentWebhookErr{err}
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(w.Secret, ts, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return &permanentWebhookErr{fmt.Errorf("webhook returned status %d", resp.StatusCode)}
+}
+
+func webhookSignature(secret, ts string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/psanford/lambda-email/snsmsg"
+)
+
+func TestWebhook(t *testing.T) {
+	conf = &Config{
+		Bucket: Bucket{
+			Name:      "westerly-tapir",
+			MsgPrefix: "/periphery-corollas",
+		},
+	}
+	s3GetObjReq = fakeGetObjReq
+
+	secret := "swordfish"
+
+	var (
+		attempts int
+		got      snsmsg.Msg
+	)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := r.Header.Get(webhookTimestampHeader)
+		if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+			t.Errorf("bad timestamp header %q", ts)
+		}
+		expectSig := "sha256=" + webhookSignature(secret, ts, body)
+		if sig := r.Header.Get(webhookSignatureHeader); sig != expectSig {
+			t.Errorf("signature mismatch got %q expected %q", sig, expectSig)
+		}
+
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	webhookClient = server.Client()
+	webhookBackoff = time.Millisecond
+	defer func() {
+		webhookClient = http.DefaultClient
+		webhookBackoff = time.Second
+	}()
+
+	sse := loadTestEvent(t)
+	record := sse.Records[0]
+
+	env, err := enmime.ReadEnvelope(strings.NewReader("Subject: hi\r\nContent-Type: text/plain\r\n\r\nhello there\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := newMsg(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wh := Webhook{
+		URL:         server.URL,
+		Secret:      secret,
+		IncludeBody: true,
+	}
+
+	if err := postWebhook(wh, msg, env); err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts but got %d", attempts)
+	}
+	if got.ID != record.SES.Mail.MessageID {
+		t.Errorf("webhook msg id got %q expected %q", got.ID, record.SES.Mail.MessageID)
+	}
+	if strings.TrimSpace(got.Text) != "hello there" {
+		t.Errorf("webhook msg text got %q", got.Text)
+	}
+
+	// client errors are not retried
+	attempts = 0
+	badServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer badServer.Close()
+	webhookClient = badServer.Client()
+
+	wh.URL = badServer.URL
+	if err := postWebhook(wh, msg, env); err == nil {
+		t.Fatal("expected webhook error")
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt for client error but got %d", attempts)
+	}
+
+	// timeouts are retried up to max_attempts
+	attempts = 0
+	slowServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slowServer.Close()
+	webhookClient = slowServer.Client()
+
+	wh.URL = slowServer.URL
+	wh.Timeout = duration{10 * time.Millisecond}
+	wh.MaxAttempts = 2
+	if err := postWebhook(wh, msg, env); err == nil {
+		t.Fatal("expected webhook timeout error")
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts for timeout but got %d", attempts)
+	}
+}